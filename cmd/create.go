@@ -1,38 +1,40 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 
 	"github.com/dataswap/go-metadata/libs"
 	metaservice "github.com/dataswap/go-metadata/service"
-	"github.com/filecoin-project/boost-gfm/stores"
+	"github.com/dataswap/go-metadata/types"
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-cidutil/cidenc"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	files "github.com/ipfs/go-ipfs-files"
 	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
-	"github.com/ipfs/go-unixfs/importer/balanced"
 	"github.com/ipfs/go-unixfs/importer/helpers"
-	"github.com/ipld/go-car"
-	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	uio "github.com/ipfs/go-unixfs/io"
 	"github.com/multiformats/go-multibase"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
 )
 
-var MaxTraversalLinks uint64 = 32 * (1 << 20)
-
 var createCmd = &cli.Command{
 	Name:  "create",
 	Usage: "Create a car file",
 	Subcommands: []*cli.Command{
 		createCarCmd,
+		createPackCmd,
 		createChunksCmd,
 	},
 }
@@ -40,9 +42,11 @@ var createCmd = &cli.Command{
 var createCarCmd = &cli.Command{
 	Name:      "car",
 	Usage:     "Create a car file",
-	ArgsUsage: "<inputPath> <outputPath>",
-	Action:    CreateCar,
-	Flags: []cli.Flag{
+	ArgsUsage: "<inputPath> [<inputPath>...] <outputPath>",
+	Description: "Each input path may be a single file or a directory, directories are imported recursively as a UnixFS directory DAG.\n" +
+		"   When several input paths are given they are linked by their base names into one root directory.",
+	Action: CreateCar,
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:     "mapping-path",
 			Usage:    "The meta mapping path to write to",
@@ -53,74 +57,257 @@ var createCarCmd = &cli.Command{
 			Usage:    "The parent path",
 			Required: true,
 		},
+		&cli.StringFlag{
+			Name:     "cache-path",
+			Usage:    "The commP cache path to write the level cache and the dataset commPs to",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "hamt-threshold",
+			Usage: "The estimated directory size in bytes above which directories are sharded as HAMTs, 0 disables sharding",
+			Value: uio.HAMTShardingSize,
+		},
+		&cli.StringFlag{
+			Name:  "checkpoint-path",
+			Usage: "The directory to checkpoint the completed files to, a restarted run with the same flags resumes after them",
+		},
+		&cli.DurationFlag{
+			Name:  "checkpoint-interval",
+			Usage: "The interval between two syncs of the checkpoint to the disk",
+			Value: metaservice.CHECKPOINT_INTERVAL,
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Usage: "The number of files hashed concurrently, the car does not depend on it",
+			Value: runtime.NumCPU(),
+		},
+		&cli.IntFlag{
+			Name:  "mapping-spill-limit",
+			Usage: "The number of mappings and of car block offsets kept in memory, the others are spilled to the disk under the mapping path until they are saved, 0 keeps them all in memory",
+			Value: metaservice.MAPPING_SPILL_LIMIT,
+		},
+	}, dagFlags...),
+}
+
+// dagFlags are the flags of the DAG parameters of created cars, read by dagParams.
+var dagFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "chunker",
+		Usage: "The chunker splitting files into leaves, size-<bytes>, rabin[-<min>-<avg>-<max>] or buzhash",
+		Value: libs.DefaultChunker,
+	},
+	&cli.StringFlag{
+		Name:  "layout",
+		Usage: "The DAG layout of files, balanced or trickle",
+		Value: libs.BalancedLayout,
+	},
+	&cli.BoolFlag{
+		Name:  "raw-leaves",
+		Usage: "Use raw nodes for the leaves of files",
+	},
+	&cli.IntFlag{
+		Name:  "max-links",
+		Usage: "The maximum number of links of a DAG node",
+		Value: libs.UnixfsLinksPerLevel,
+	},
+	&cli.IntFlag{
+		Name:  "cid-version",
+		Usage: "The CID version of the DAG nodes, 0 or 1",
+		Value: 1,
+	},
+	&cli.StringFlag{
+		Name:  "hash",
+		Usage: "The multihash function of the DAG nodes, sha2-256, blake2b-256 or blake3",
+		Value: DefaultHashFunction,
 	},
 }
 
 // Refer to the boostx code at github.com/filecoin-project/boost/cmd/boostx/utils_cmd.go for functional validation.
 func CreateCar(cctx *cli.Context) error {
-	if cctx.Args().Len() != 2 {
-		return xerrors.Errorf("usage: create <inputPath> <outputPath>")
+	if cctx.Args().Len() < 2 {
+		return xerrors.Errorf("usage: create <inputPath> [<inputPath>...] <outputPath>")
 	}
 
-	inPath := cctx.Args().First()
-	outPath := cctx.Args().Get(1)
+	inPaths := cctx.Args().Slice()[:cctx.Args().Len()-1]
+	outPath := cctx.Args().Get(cctx.Args().Len() - 1)
 
-	ftmp, err := os.CreateTemp("", "")
+	uio.HAMTShardingSize = cctx.Int("hamt-threshold")
+
+	params, err := dagParams(cctx)
 	if err != nil {
-		return xerrors.Errorf("failed to create temp file: %w", err)
+		return err
 	}
-	_ = ftmp.Close() // close; we only want the path.
 
-	tmp := ftmp.Name()
-	defer os.Remove(tmp) //nolint:errcheck
-	msrv := metaservice.New()
-	// generate and import the UnixFS DAG into a filestore (positional reference) CAR.
-	root, err := CreateFilestore(cctx.Context, inPath, tmp, msrv, cctx.String("source-parent-path"))
-	if err != nil {
-		return xerrors.Errorf("failed to import file using unixfs: %w", err)
+	var cp *metaservice.Checkpoint
+	if cctx.String("checkpoint-path") != "" {
+		cp, err = metaservice.OpenCheckpoint(cctx.String("checkpoint-path"), &metaservice.CheckpointMeta{
+			Inputs:        inPaths,
+			Parent:        cctx.String("source-parent-path"),
+			HamtThreshold: uio.HAMTShardingSize,
+			Params:        params,
+		}, cctx.Duration("checkpoint-interval"))
+		if err != nil {
+			return err
+		}
+		defer cp.Close() //nolint:errcheck
+		if n := cp.Len(); n != 0 {
+			log.Infof("resuming from the checkpoint of %d completed files", n)
+		}
 	}
-	msrv.SetCarDataRoot(root)
 
-	// open the positional reference CAR as a filestore.
-	fs, err := stores.ReadOnlyFilestore(tmp)
-	if err != nil {
-		return xerrors.Errorf("failed to open filestore from carv2 in path %s: %w", outPath, err)
+	// files are hashed ahead on workers, the DAG build then adds them in its order from their mappings.
+	var pool *metaservice.FilePool
+	if workers := cctx.Int("parallel"); workers > 1 {
+		paths, err := ListFiles(inPaths)
+		if err != nil {
+			return err
+		}
+		if len(paths) > 1 {
+			pool = metaservice.NewFilePool(cctx.Context, workers, paths, func(ctx context.Context, path string, into bstore.Blockstore) (*metaservice.CheckpointFile, error) {
+				return HashFile(ctx, path, into, params, cp, cctx.String("source-parent-path"))
+			})
+			defer pool.Close()
+		}
 	}
-	defer fs.Close() //nolint:errcheck
 
-	f, err := os.Create(outPath)
+	// the DAG parameters are recorded in the mapping file, so the car is rebuilt with the same ones.
+	// mappings placed in the car and the offsets of its blocks are spilled next to the mapping file, so the memory
+	// does not grow with the dataset.
+	msrv := metaservice.New(metaservice.DagParams(params), metaservice.SpillMappings(cctx.String("mapping-path"), cctx.Int("mapping-spill-limit")))
+	defer msrv.Close() //nolint:errcheck
+	// generate the UnixFS DAG and write it to the CAR in a single pass.
+	root, cw, err := WriteCar(outPath, params.Prefix, msrv, func(into bstore.Blockstore) (cid.Cid, error) {
+		return BuildPaths(cctx.Context, inPaths, into, params, cp, pool, msrv, cctx.String("source-parent-path"))
+	})
 	if err != nil {
 		return err
 	}
 
-	// build a dense deterministic CAR (dense = containing filled leaves)
-	if err := car.NewSelectiveCar(
-		cctx.Context,
-		fs,
-		[]car.Dag{{
-			Root:     root,
-			Selector: selectorparse.CommonSelector_ExploreAllRecursively,
-		}},
-		car.MaxTraversalLinks(MaxTraversalLinks),
-	).Write(
-		msrv.GenerateCarWriter(f, outPath, true),
-	); err != nil {
-		return xerrors.Errorf("failed to write CAR to output file: %w", err)
-	}
-
-	err = f.Close()
+	commCid, err := SavePiece(cw, cctx.String("cache-path"))
 	if err != nil {
 		return err
 	}
+	_, pieceSize, _ := cw.Sum()
 
 	encoder := cidenc.Encoder{Base: multibase.MustNewEncoder(multibase.Base32)}
 
 	log.Info("Payload CID: ", encoder.Encode(root))
+	log.Info("Piece CID: ", commCid, ", piece size: ", pieceSize)
+
+	// mappings are named by the piece CID, as challenge proofs look them up.
+	if err := msrv.SaveMetaMappings(cctx.String("mapping-path"), commCid.String()+metaservice.MAPPING_FILE_SUFFIX); err != nil {
+		return err
+	}
+	if cp != nil {
+		return cp.Remove()
+	}
+	return nil
+}
+
+// dagParams returns the DAG parameters of the chunker, layout, raw-leaves, max-links, cid-version and hash flags.
+func dagParams(cctx *cli.Context) (types.DagParams, error) {
+	prefix, err := CidBuilder(cctx.Int("cid-version"), cctx.String("hash"))
+	if err != nil {
+		return types.DagParams{}, err
+	}
+	params := types.DagParams{
+		Prefix:    prefix,
+		Chunker:   cctx.String("chunker"),
+		Layout:    cctx.String("layout"),
+		RawLeaves: cctx.Bool("raw-leaves"),
+		MaxLinks:  cctx.Int("max-links"),
+	}
+
+	if _, err := chunker.FromString(bytes.NewReader(nil), params.Chunker); err != nil {
+		return params, xerrors.Errorf("invalid chunker %q: %w", params.Chunker, err)
+	}
+	if params.Layout != libs.BalancedLayout && params.Layout != libs.TrickleLayout {
+		return params, xerrors.Errorf("invalid layout %q, must be %s or %s", params.Layout, libs.BalancedLayout, libs.TrickleLayout)
+	}
+	if params.MaxLinks < 2 {
+		return params, xerrors.Errorf("max-links must be at least 2")
+	}
+	return params, nil
+}
+
+// SavePiece stores the level cache of the CAR hashed by cw under cachePath and registers the piece in the
+// dataset commP cache, so dataset and challenge proofs can be generated for it.
+func SavePiece(cw *metaservice.CommPWriter, cachePath string) (cid.Cid, error) {
+	rawCommP, _, err := cw.Sum()
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("failed to compute commP: %w", err)
+	}
+	commCid, err := cw.PieceCid()
+	if err != nil {
+		return cid.Undef, err
+	}
 
-	return msrv.SaveMetaMappings(cctx.String("mapping-path"), root.String()+metaservice.MAPPING_FILE_SUFFIX)
+	if err := cw.StoreLevelCache(cachePath); err != nil {
+		return cid.Undef, xerrors.Errorf("failed to store level cache: %w", err)
+	}
+	if err := metaservice.SaveCommP(rawCommP, cw.Size(), cachePath); err != nil {
+		return cid.Undef, xerrors.Errorf("failed to save commP: %w", err)
+	}
+
+	return commCid, nil
 }
 
-func CreateFilestore(ctx context.Context, srcPath string, dstPath string, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
+// WriteCar writes the CAR of the DAG built by build into the CarWriter to outPath, recording its root and the CAR
+// offsets of the blocks in msrv as they are written. The CAR is hashed into the returned commP writer as it is written.
+func WriteCar(outPath string, prefix cid.Prefix, msrv *metaservice.MappingService, build func(into bstore.Blockstore) (cid.Cid, error)) (cid.Cid, *metaservice.CommPWriter, error) {
+	car, err := metaservice.NewCarWriter(outPath, prefix)
+	if err != nil {
+		return cid.Undef, nil, xerrors.Errorf("failed to create CAR file: %w", err)
+	}
+	msrv.RecordCarBlocks(car)
+
+	root, err := build(car)
+	if err != nil {
+		_ = car.Close()
+		return cid.Undef, nil, xerrors.Errorf("failed to import file using unixfs: %w", err)
+	}
+	if err := car.Finish(root); err != nil {
+		return cid.Undef, nil, xerrors.Errorf("failed to write CAR to output file: %w", err)
+	}
+	msrv.SetCarDataRoot(root)
+	if err := msrv.FinishCarBlocks(); err != nil {
+		return cid.Undef, nil, xerrors.Errorf("failed to record the offsets of %s: %w", outPath, err)
+	}
+
+	return root, car.CommP(), nil
+}
+
+// BuildPaths imports the input paths into the blockstore. A single path is imported as a UnixFS file or,
+// for directories, as a UnixFS directory tree. Several paths are linked into one root directory.
+func BuildPaths(ctx context.Context, srcPaths []string, into bstore.Blockstore, params types.DagParams, cp *metaservice.Checkpoint, pool *metaservice.FilePool, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
+	if len(srcPaths) == 1 {
+		stat, err := os.Stat(srcPaths[0])
+		if err != nil {
+			return cid.Undef, xerrors.Errorf("failed to stat input: %w", err)
+		}
+		if !stat.IsDir() {
+			return BuildFile(ctx, srcPaths[0], into, params, cp, pool, msrv, parent)
+		}
+	}
+
+	bsvc := blockservice.New(into, offline.Exchange(into))
+	dags := merkledag.NewDAGService(bsvc)
+
+	var nd ipld.Node
+	var err error
+	if len(srcPaths) == 1 {
+		nd, err = BuildDirectory(ctx, srcPaths[0], into, dags, params, cp, pool, msrv, parent)
+	} else {
+		nd, err = BuildEntries(ctx, srcPaths, into, dags, params, cp, pool, msrv, parent)
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// BuildFile imports a single regular file into the blockstore.
+func BuildFile(ctx context.Context, srcPath string, into bstore.Blockstore, params types.DagParams, cp *metaservice.Checkpoint, pool *metaservice.FilePool, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
 	src, err := os.Open(srcPath)
 	if err != nil {
 		return cid.Undef, xerrors.Errorf("failed to open input file: %w", err)
@@ -132,118 +319,322 @@ func CreateFilestore(ctx context.Context, srcPath string, dstPath string, msrv *
 		return cid.Undef, xerrors.Errorf("failed to stat file :%w", err)
 	}
 
+	if pool != nil {
+		f, blks, err := pool.File(ctx, srcPath)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if f.Size != uint64(stat.Size()) || f.ModTime != stat.ModTime().UnixNano() {
+			return cid.Undef, xerrors.Errorf("%s changed while being imported", srcPath)
+		}
+		return addFile(ctx, f, blks, into, params, msrv, parent)
+	}
+
 	file, err := files.NewReaderPathFile(srcPath, src, stat)
 	if err != nil {
 		return cid.Undef, xerrors.Errorf("failed to create reader path file: %w", err)
 	}
 
-	f, err := os.CreateTemp("", "")
+	if cp == nil {
+		return Build(ctx, file, into, true, srcPath, 0, params, msrv, parent)
+	}
+	return buildCheckpointed(ctx, file, stat, into, srcPath, params, cp, msrv, parent)
+}
+
+// buildCheckpointed imports a file and records its DAG in the checkpoint. The DAG of a checkpointed file is added
+// to the blockstore again from its mappings, without hashing the file.
+func buildCheckpointed(ctx context.Context, file files.File, stat os.FileInfo, into bstore.Blockstore, srcPath string, params types.DagParams, cp *metaservice.Checkpoint, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
+	if f := cp.File(srcPath, 0, uint64(stat.Size()), stat.ModTime()); f != nil {
+		return addFile(ctx, f, nil, into, params, msrv, parent)
+	}
+
+	// the mappings of the file are collected on their own to be checkpointed, and recorded in msrv as they are.
+	opts := []metaservice.Option{metaservice.DagParams(params)}
+	if msrv != nil {
+		opts = append(opts, metaservice.RecordInto(msrv))
+	}
+	fms := metaservice.New(opts...)
+	root, err := Build(ctx, file, into, true, srcPath, 0, params, fms, parent)
 	if err != nil {
-		return cid.Undef, xerrors.Errorf("failed to create temp file: %w", err)
+		return cid.Undef, err
 	}
-	_ = f.Close() // close; we only want the path.
+	f := newCheckpointFile(srcPath, stat, root, fms)
+	if err := cp.AddFile(f); err != nil {
+		return cid.Undef, xerrors.Errorf("failed to checkpoint %s: %w", srcPath, err)
+	}
+	return f.Root, nil
+}
 
-	tmp := f.Name()
-	defer os.Remove(tmp) //nolint:errcheck
+// HashFile builds the DAG of a file with its own mappings into a blockstore of its own, so it is added to the
+// blockstore of the car later, from its blocks or from its mappings. The DAG recorded in the checkpoint is taken
+// instead when there is one, and the DAG hashed is recorded in it.
+func HashFile(ctx context.Context, srcPath string, into bstore.Blockstore, params types.DagParams, cp *metaservice.Checkpoint, parent string) (*metaservice.CheckpointFile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	// Step 1. Compute the UnixFS DAG and write it to a CARv2 file to get
-	// the root CID of the DAG.
-	fstore, err := stores.ReadWriteFilestore(tmp)
+	src, err := os.Open(srcPath)
 	if err != nil {
-		return cid.Undef, xerrors.Errorf("failed to create temporary filestore: %w", err)
+		return nil, xerrors.Errorf("failed to open input file: %w", err)
 	}
+	defer src.Close()
 
-	finalRoot1, err := Build(ctx, file, fstore, true, srcPath, 0, nil, parent)
+	stat, err := src.Stat()
 	if err != nil {
-		_ = fstore.Close()
-		return cid.Undef, xerrors.Errorf("failed to import file to store to compute root: %w", err)
+		return nil, xerrors.Errorf("failed to stat file :%w", err)
+	}
+	if cp != nil {
+		if f := cp.File(srcPath, 0, uint64(stat.Size()), stat.ModTime()); f != nil {
+			return f, nil
+		}
 	}
 
-	if err := fstore.Close(); err != nil {
-		return cid.Undef, xerrors.Errorf("failed to finalize car filestore: %w", err)
+	file, err := files.NewReaderPathFile(srcPath, src, stat)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create reader path file: %w", err)
 	}
 
-	// Step 2. We now have the root of the UnixFS DAG, and we can write the
-	// final CAR for real under `dst`.
-	bs, err := stores.ReadWriteFilestore(dstPath, finalRoot1)
+	fms := metaservice.New(metaservice.DagParams(params))
+	root, err := Build(ctx, file, into, true, srcPath, 0, params, fms, parent)
 	if err != nil {
-		return cid.Undef, xerrors.Errorf("failed to create a carv2 read/write filestore: %w", err)
+		return nil, err
 	}
+	f := newCheckpointFile(srcPath, stat, root, fms)
+	if cp != nil {
+		if err := cp.AddFile(f); err != nil {
+			return nil, xerrors.Errorf("failed to checkpoint %s: %w", srcPath, err)
+		}
+	}
+	return f, nil
+}
 
-	// rewind file to the beginning.
-	if _, err := src.Seek(0, 0); err != nil {
-		return cid.Undef, xerrors.Errorf("failed to rewind file: %w", err)
+// newCheckpointFile returns the DAG of a file built with its own mappings.
+func newCheckpointFile(srcPath string, stat os.FileInfo, root cid.Cid, fms *metaservice.MappingService) *metaservice.CheckpointFile {
+	return &metaservice.CheckpointFile{
+		Path:     srcPath,
+		Size:     uint64(stat.Size()),
+		ModTime:  stat.ModTime().UnixNano(),
+		Root:     root,
+		Mappings: fms.CheckpointMappings(),
 	}
+}
 
-	finalRoot2, err := Build(ctx, file, bs, true, srcPath, 0, msrv, parent)
-	if err != nil {
-		_ = bs.Close()
-		return cid.Undef, xerrors.Errorf("failed to create UnixFS DAG with carv2 blockstore: %w", err)
+// addFile adds the DAG of a file hashed before to the blockstore and records its mappings. The blocks hashed are
+// added in their order when they were kept, the DAG is rebuilt from the mappings and the source data otherwise.
+// The mappings are recorded first, so the blocks are placed as they are written.
+func addFile(ctx context.Context, f *metaservice.CheckpointFile, blks []blocks.Block, into bstore.Blockstore, params types.DagParams, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
+	if msrv != nil {
+		msrv.RecordCheckpointFile(f)
+	}
+	if blks != nil {
+		if err := into.PutMany(ctx, blks); err != nil {
+			return cid.Undef, xerrors.Errorf("failed to add the hashed blocks of %s: %w", f.Path, err)
+		}
+	} else if err := addCheckpointFile(ctx, f, into, params, parent); err != nil {
+		return cid.Undef, xerrors.Errorf("failed to add the hashed dag of %s: %w", f.Path, err)
 	}
+	return f.Root, nil
+}
+
+// addCheckpointFile adds the nodes of a checkpointed DAG to the blockstore.
+func addCheckpointFile(ctx context.Context, f *metaservice.CheckpointFile, into bstore.Blockstore, params types.DagParams, parent string) error {
+	bsvc := blockservice.New(into, offline.Exchange(into))
+	dags := merkledag.NewDAGService(bsvc)
+
+	return f.Nodes(parent, params, func(node ipld.Node, m *types.ChunkMapping) error {
+		return dags.Add(ctx, node)
+	})
+}
 
-	if err := bs.Close(); err != nil {
-		return cid.Undef, xerrors.Errorf("failed to finalize car blockstore: %w", err)
+// BuildDirectory imports every regular file and sub directory of dirPath into a UnixFS directory.
+// Entries are visited in lexical order so the resulting DAG is deterministic.
+func BuildDirectory(ctx context.Context, dirPath string, into bstore.Blockstore, dags ipld.DAGService, params types.DagParams, cp *metaservice.Checkpoint, pool *metaservice.FilePool, msrv *metaservice.MappingService, parent string) (ipld.Node, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read directory %s: %w", dirPath, err)
 	}
 
-	if finalRoot1 != finalRoot2 {
-		return cid.Undef, xerrors.New("roots do not match")
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(dirPath, entry.Name()))
 	}
 
-	return finalRoot2, nil
+	return BuildEntries(ctx, paths, into, dags, params, cp, pool, msrv, parent)
 }
 
-const UnixfsLinksPerLevel = 1024
+// BuildEntries imports the given files and directories and links them by their base names into a UnixFS directory,
+// which is sharded as a HAMT once it grows above uio.HAMTShardingSize.
+func BuildEntries(ctx context.Context, paths []string, into bstore.Blockstore, dags ipld.DAGService, params types.DagParams, cp *metaservice.Checkpoint, pool *metaservice.FilePool, msrv *metaservice.MappingService, parent string) (ipld.Node, error) {
+	b := params.Prefix
 
-func Build(ctx context.Context, reader io.Reader, into bstore.Blockstore, filestore bool, srcPath string, chunkStart uint64, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
-	b, err := CidBuilder()
+	// Directory nodes do not come from the source data, they are recorded through the DAGService.
+	dserv := dags
+	if msrv != nil {
+		dserv = msrv.GenerateDagService(dags)
+	}
+
+	dir := uio.NewDirectory(dserv)
+	dir.SetCidBuilder(b)
+
+	names := make(map[string]struct{}, len(paths))
+	for _, entryPath := range paths {
+		name := filepath.Base(entryPath)
+		if _, ok := names[name]; ok {
+			return nil, xerrors.Errorf("duplicate directory entry name %s", name)
+		}
+		names[name] = struct{}{}
+
+		stat, err := os.Lstat(entryPath)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to stat %s: %w", entryPath, err)
+		}
+
+		var child ipld.Node
+		switch {
+		case stat.IsDir():
+			child, err = BuildDirectory(ctx, entryPath, into, dags, params, cp, pool, msrv, parent)
+			if err != nil {
+				return nil, err
+			}
+		case stat.Mode().IsRegular():
+			c, err := BuildFile(ctx, entryPath, into, params, cp, pool, msrv, parent)
+			if err != nil {
+				return nil, err
+			}
+			if child, err = dags.Get(ctx, c); err != nil {
+				return nil, xerrors.Errorf("failed to load file node %s: %w", entryPath, err)
+			}
+		default:
+			log.Warnf("skipping %s: not a regular file or directory", entryPath)
+			continue
+		}
+
+		if err := dir.AddChild(ctx, name, child); err != nil {
+			return nil, xerrors.Errorf("failed to add %s to directory: %w", entryPath, err)
+		}
+	}
+
+	nd, err := dir.GetNode()
 	if err != nil {
-		return cid.Undef, err
+		return nil, err
+	}
+	if err := dserv.Add(ctx, nd); err != nil {
+		return nil, err
 	}
 
+	return nd, nil
+}
+
+// ListFiles lists the regular files of the input paths in the order BuildPaths imports them.
+func ListFiles(srcPaths []string) ([]string, error) {
+	var paths []string
+	var walk func(entryPath string, stat os.FileInfo) error
+	walk = func(entryPath string, stat os.FileInfo) error {
+		switch {
+		case stat.IsDir():
+			entries, err := os.ReadDir(entryPath)
+			if err != nil {
+				return xerrors.Errorf("failed to read directory %s: %w", entryPath, err)
+			}
+			for _, entry := range entries {
+				p := filepath.Join(entryPath, entry.Name())
+				stat, err := os.Lstat(p)
+				if err != nil {
+					return xerrors.Errorf("failed to stat %s: %w", p, err)
+				}
+				if err := walk(p, stat); err != nil {
+					return err
+				}
+			}
+		case stat.Mode().IsRegular():
+			paths = append(paths, entryPath)
+		}
+		return nil
+	}
+
+	for _, srcPath := range srcPaths {
+		// a single input is followed if it is a link, as by BuildPaths.
+		stat, err := os.Lstat(srcPath)
+		if len(srcPaths) == 1 {
+			stat, err = os.Stat(srcPath)
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("failed to stat input: %w", err)
+		}
+		if err := walk(srcPath, stat); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// Build imports the data of reader as a UnixFS file DAG built with the chunker, layout and leaves of params.
+func Build(ctx context.Context, reader io.Reader, into bstore.Blockstore, filestore bool, srcPath string, chunkStart uint64, params types.DagParams, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
+	b := params.Prefix
+
+	// nodes are added one at a time, so they reach the blockstore in the order they are built.
 	bsvc := blockservice.New(into, offline.Exchange(into))
 	dags := merkledag.NewDAGService(bsvc)
-	bufdag := ipld.NewBufferedDAG(ctx, dags)
 	var db helpers.Helper
-	params := helpers.DagBuilderParams{
-		Maxlinks:   UnixfsLinksPerLevel,
-		RawLeaves:  false,
+	dbParams := helpers.DagBuilderParams{
+		Maxlinks:   params.MaxLinks,
+		RawLeaves:  params.RawLeaves,
 		CidBuilder: b,
-		Dagserv:    bufdag,
+		Dagserv:    dags,
 		NoCopy:     filestore,
 	}
 
-	spl, err := libs.NewSplitter(reader, int64(libs.UnixfsChunkSize), srcPath, parent, chunkStart)
+	spl, err := libs.NewSplitter(reader, params.Chunker, srcPath, parent, chunkStart)
+	if err != nil {
+		return cid.Undef, err
+	}
 	if msrv != nil {
-		params.Dagserv = msrv.GenerateDagService(bufdag)
-		db, err = msrv.GenerateHelper(&params, spl)
+		dbParams.Dagserv = msrv.GenerateDagService(dags)
+		db, err = msrv.GenerateHelper(&dbParams, spl)
 	} else {
-		db, err = params.New(spl)
+		db, err = dbParams.New(spl)
 	}
 
 	if err != nil {
 		return cid.Undef, err
 	}
+	// filestore references of a file range are relative to the start of the file.
+	db.SetOffset(chunkStart)
 
-	nd, err := balanced.Layout(db)
+	nd, err := libs.Layout(db, params.Layout)
 	if err != nil {
 		return cid.Undef, err
 	}
 
-	if err := bufdag.Commit(); err != nil {
-		return cid.Undef, err
-	}
-
 	return nd.Cid(), nil
 }
 
-var DefaultHashFunction = uint64(mh.BLAKE2B_MIN + 31)
+const DefaultHashFunction = "sha2-256"
 
-func CidBuilder() (cid.Builder, error) {
-	prefix, err := merkledag.PrefixForCidVersion(1)
+// HashFunctions are the multihash functions DAG nodes can be hashed with.
+var HashFunctions = map[string]uint64{
+	"sha2-256":    mh.SHA2_256,
+	"blake2b-256": mh.BLAKE2B_MIN + 31,
+	"blake3":      mh.BLAKE3,
+}
+
+// CidBuilder returns the CID prefix of the DAG nodes of the given CID version and multihash function.
+func CidBuilder(version int, hash string) (cid.Prefix, error) {
+	prefix, err := merkledag.PrefixForCidVersion(version)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to initialize UnixFS CID Builder: %w", err)
+		return cid.Prefix{}, xerrors.Errorf("failed to initialize UnixFS CID Builder: %w", err)
 	}
 
+	mhType, ok := HashFunctions[hash]
+	if !ok {
+		return cid.Prefix{}, xerrors.Errorf("unsupported hash function %q, must be sha2-256, blake2b-256 or blake3", hash)
+	}
+	if version == 0 && mhType != mh.SHA2_256 {
+		return cid.Prefix{}, xerrors.Errorf("CIDv0 only supports sha2-256")
+	}
+	prefix.MhType = mhType
+	prefix.MhLength = -1
+
 	return prefix, nil
 }
 
@@ -260,7 +651,7 @@ var createChunksCmd = &cli.Command{
 		},
 		&cli.StringFlag{
 			Name:     "source-parent-path",
-			Usage:    "The source data parent path",
+			Usage:    "The source data parent path, a local directory, an http(s):// URL or an s3://bucket/prefix URI",
 			Required: true,
 		},
 	},
@@ -279,9 +670,18 @@ func CreateChunks(cctx *cli.Context) error {
 	if err := msrv.LoadMetaMappings(cctx.String("mapping-file")); err != nil {
 		return err
 	}
-	metas, err := msrv.GetAllChunkMappings()
+	vc, err := metaservice.NewVirtualCar(msrv, cctx.String("source-parent-path"))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(outPath)
 	if err != nil {
 		return err
 	}
-	return msrv.GenerateChunksFromMappings(outPath, cctx.String("source-parent-path"), metas)
+	if _, err := io.Copy(f, vc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
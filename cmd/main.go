@@ -20,6 +20,8 @@ func main() {
 			listCmd,
 			proofCmd,
 			verifyCmd,
+			serveCmd,
+			regenerateCmd,
 			toolsCmd,
 		},
 	}
@@ -27,9 +29,8 @@ func main() {
 	err := app.Run(os.Args)
 	if err != nil {
 		log.Error(err)
-		return
+		os.Exit(1)
 	}
-	return
 }
 
 func before(cctx *cli.Context) error {
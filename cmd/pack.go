@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"math/bits"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dataswap/go-metadata/libs"
+	metaservice "github.com/dataswap/go-metadata/service"
+	"github.com/dataswap/go-metadata/types"
+	"github.com/dataswap/go-metadata/utils"
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	PACK_MANIFEST_FILE = "manifest.json"
+	CAR_FILE_SUFFIX    = ".car"
+)
+
+// Estimates used to fill a car up to the piece capacity, they are deliberately on the high side.
+const (
+	// bytes reserved for the car header
+	packCarHeaderSize = 128
+	// car bytes of a chunk besides its data: block header, unixfs framing and the link from its parent
+	packChunkOverhead = 128
+	// car bytes of a file or directory besides its chunks and name: root block and directory entry
+	packEntryOverhead = 256
+)
+
+var createPackCmd = &cli.Command{
+	Name:      "pack",
+	Usage:     "Pack files or directories into car files of a target piece size",
+	ArgsUsage: "<inputPath> [<inputPath>...] <outputDir>",
+	Description: "Files are packed in lexical order and files that do not fit are split across cars at chunk boundaries.\n" +
+		"   Each car gets a mapping file named by its piece CID, the output directory gets a manifest.json listing every car.\n" +
+		"   The DAG of the cars is built with the chunker, layout, raw-leaves, max-links, cid-version and hash flags of create car.",
+	Action: CreatePack,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "mapping-path",
+			Usage:    "The meta mapping path to write to",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "source-parent-path",
+			Usage:    "The parent path",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "cache-path",
+			Usage:    "The commP cache path to write the level caches and the dataset commPs to",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "target-size",
+			Usage: "The padded piece size of the cars, must be a power of two",
+			Value: "32GiB",
+		},
+		&cli.IntFlag{
+			Name:  "hamt-threshold",
+			Usage: "The estimated directory size in bytes above which directories are sharded as HAMTs, 0 disables sharding",
+			Value: uio.HAMTShardingSize,
+		},
+	}, dagFlags...),
+}
+
+// CreatePack packs the input paths into cars whose pieces fit the target padded size.
+func CreatePack(cctx *cli.Context) error {
+	if cctx.Args().Len() < 2 {
+		return xerrors.Errorf("usage: pack <inputPath> [<inputPath>...] <outputDir>")
+	}
+
+	inPaths := cctx.Args().Slice()[:cctx.Args().Len()-1]
+	outDir := cctx.Args().Get(cctx.Args().Len() - 1)
+	parent := cctx.String("source-parent-path")
+
+	targetSize, err := humanize.ParseBytes(cctx.String("target-size"))
+	if err != nil {
+		return xerrors.Errorf("failed to parse target size: %w", err)
+	}
+	if bits.OnesCount64(targetSize) != 1 {
+		return xerrors.Errorf("target size %d is not a power of two", targetSize)
+	}
+	// the car is fr32 padded into the piece, every 127 bytes take 128.
+	capacity := targetSize - targetSize/128
+
+	uio.HAMTShardingSize = cctx.Int("hamt-threshold")
+
+	params, err := dagParams(cctx)
+	if err != nil {
+		return err
+	}
+	// the car size is estimated with the smallest chunks of the chunker, so it is not underestimated.
+	chunkSize, err := libs.MinChunkSize(params.Chunker)
+	if err != nil {
+		return err
+	}
+
+	planner := newPackPlanner(capacity, chunkSize)
+	if err := PlanPack(inPaths, parent, planner); err != nil {
+		return err
+	}
+	cars := planner.Cars()
+
+	if err := os.MkdirAll(outDir, 0o775); err != nil {
+		return err
+	}
+
+	manifest := &types.PackManifest{
+		TargetSize: targetSize,
+		Cars:       make([]*types.CarManifest, 0, len(cars)),
+	}
+	for i, ranges := range cars {
+		cm, err := PackCar(cctx.Context, ranges, outDir, params, capacity, cctx.String("mapping-path"), cctx.String("cache-path"), parent)
+		if err != nil {
+			return xerrors.Errorf("failed to pack car %d: %w", i, err)
+		}
+		log.Infof("car %d/%d: %s, payload cid: %s, piece size: %d", i+1, len(cars), cm.Name, cm.DataRoot, cm.PieceSize)
+		manifest.Cars = append(manifest.Cars, cm)
+	}
+
+	return utils.WriteJson(filepath.Join(outDir, PACK_MANIFEST_FILE), "\t", manifest)
+}
+
+// PlanPack walks the input paths and adds their regular files to the planner in lexical order.
+// A single directory input becomes the root directory of every car, several inputs are linked by their base names.
+func PlanPack(inPaths []string, parent string, planner *packPlanner) error {
+	names := make(map[string]struct{}, len(inPaths))
+	for _, inPath := range inPaths {
+		name := filepath.Base(inPath)
+		if _, ok := names[name]; ok {
+			return xerrors.Errorf("duplicate directory entry name %s", name)
+		}
+		names[name] = struct{}{}
+
+		stat, err := os.Stat(inPath)
+		if err != nil {
+			return xerrors.Errorf("failed to stat input: %w", err)
+		}
+		prefix := name
+		if len(inPaths) == 1 && stat.IsDir() {
+			prefix = ""
+		}
+
+		err = filepath.WalkDir(inPath, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				log.Warnf("skipping %s: not a regular file or directory", p)
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			srcPath, err := filepath.Rel(filepath.Clean(parent), filepath.Clean(p))
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(inPath, p)
+			if err != nil {
+				return err
+			}
+			dagPath := path.Join(prefix, filepath.ToSlash(rel))
+			if rel == "." {
+				dagPath = prefix
+			}
+
+			return planner.Add(srcPath, dagPath, uint64(info.Size()))
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to walk %s: %w", inPath, err)
+		}
+	}
+
+	return nil
+}
+
+// packPlanner assigns source data ranges to cars by estimating the car size of the unixfs dag built for them.
+type packPlanner struct {
+	capacity  uint64
+	chunkSize uint64
+
+	cars [][]*types.FileRange
+	cur  []*types.FileRange
+	used uint64
+	dirs map[string]struct{}
+}
+
+func newPackPlanner(capacity uint64, chunkSize uint64) *packPlanner {
+	p := &packPlanner{
+		capacity:  capacity,
+		chunkSize: chunkSize,
+		cars:      make([][]*types.FileRange, 0),
+	}
+	p.reset()
+	return p
+}
+
+// Add plans the file, splitting it at chunk boundaries when it does not fit in the current car.
+func (p *packPlanner) Add(srcPath string, dagPath string, size uint64) error {
+	var offset uint64
+	for {
+		entry := p.entrySize(dagPath)
+		remain := size - offset
+		if p.used+entry+p.dataSize(remain) <= p.capacity {
+			p.push(srcPath, dagPath, offset, remain, entry+p.dataSize(remain))
+			return nil
+		}
+
+		var n uint64
+		if p.used+entry < p.capacity {
+			n = (p.capacity - p.used - entry) / (p.chunkSize + packChunkOverhead) * p.chunkSize
+		}
+		if n == 0 {
+			if len(p.cur) == 0 {
+				return xerrors.Errorf("piece capacity %d is too small to pack %s", p.capacity, srcPath)
+			}
+			p.flush()
+			continue
+		}
+
+		p.push(srcPath, dagPath, offset, n, entry+p.dataSize(n))
+		offset += n
+		p.flush()
+	}
+}
+
+// Cars returns the planned source data ranges of every car.
+func (p *packPlanner) Cars() [][]*types.FileRange {
+	p.flush()
+	return p.cars
+}
+
+// entrySize estimates the car bytes of the file entry, including its parent directories not yet in the car.
+func (p *packPlanner) entrySize(dagPath string) uint64 {
+	size := uint64(packEntryOverhead + len(dagPath))
+	for dir := path.Dir(dagPath); dir != "."; dir = path.Dir(dir) {
+		if _, ok := p.dirs[dir]; !ok {
+			size += uint64(packEntryOverhead + len(dir))
+		}
+	}
+	return size
+}
+
+// dataSize estimates the car bytes of size bytes of file data.
+func (p *packPlanner) dataSize(size uint64) uint64 {
+	chunks := (size + p.chunkSize - 1) / p.chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*packChunkOverhead
+}
+
+func (p *packPlanner) push(srcPath string, dagPath string, offset uint64, size uint64, estimate uint64) {
+	for dir := path.Dir(dagPath); dir != "."; dir = path.Dir(dir) {
+		p.dirs[dir] = struct{}{}
+	}
+	p.cur = append(p.cur, &types.FileRange{
+		SrcData: types.SrcData{Path: srcPath, Offset: offset, Size: size},
+		DagPath: dagPath,
+	})
+	p.used += estimate
+}
+
+func (p *packPlanner) flush() {
+	if len(p.cur) != 0 {
+		p.cars = append(p.cars, p.cur)
+	}
+	p.reset()
+}
+
+func (p *packPlanner) reset() {
+	p.cur = make([]*types.FileRange, 0)
+	p.used = packCarHeaderSize + packEntryOverhead
+	p.dirs = make(map[string]struct{})
+}
+
+// PackCar creates the car of the source data ranges with the DAG parameters under outDir, saves its mapping file
+// and registers its piece. A car larger than capacity fails before anything of it is saved.
+func PackCar(ctx context.Context, ranges []*types.FileRange, outDir string, params types.DagParams, capacity uint64, mappingPath string, cachePath string, parent string) (*types.CarManifest, error) {
+	// the car is named by its piece CID once it is written.
+	ftmp, err := os.CreateTemp(outDir, "*"+CAR_FILE_SUFFIX)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create temp file: %w", err)
+	}
+	_ = ftmp.Close() // close; we only want the path.
+
+	carPath := ftmp.Name()
+	defer os.Remove(carPath) //nolint:errcheck
+
+	// the DAG parameters are recorded in the mapping file, so the car is rebuilt with the same ones.
+	msrv := metaservice.New(metaservice.DagParams(params))
+	root, cw, err := WriteCar(carPath, params.Prefix, msrv, func(into bstore.Blockstore) (cid.Cid, error) {
+		return BuildRanges(ctx, ranges, into, params, msrv, parent)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cw.Size() > capacity {
+		return nil, xerrors.Errorf("car size %d exceeds the piece capacity %d", cw.Size(), capacity)
+	}
+
+	commCid, err := SavePiece(cw, cachePath)
+	if err != nil {
+		return nil, err
+	}
+	_, pieceSize, _ := cw.Sum()
+
+	name := commCid.String() + CAR_FILE_SUFFIX
+	if err := os.Rename(carPath, filepath.Join(outDir, name)); err != nil {
+		return nil, err
+	}
+
+	if err := msrv.SaveMetaMappings(mappingPath, commCid.String()+metaservice.MAPPING_FILE_SUFFIX); err != nil {
+		return nil, err
+	}
+
+	return &types.CarManifest{
+		Name:      name,
+		DataRoot:  root,
+		PieceCid:  commCid,
+		PieceSize: pieceSize,
+		CarSize:   cw.Size(),
+		Files:     ranges,
+	}, nil
+}
+
+// packDir is a directory of the unixfs dag built for packed source data ranges.
+type packDir struct {
+	dirs  map[string]*packDir
+	files map[string]*types.FileRange
+}
+
+func newPackDir() *packDir {
+	return &packDir{
+		dirs:  make(map[string]*packDir),
+		files: make(map[string]*types.FileRange),
+	}
+}
+
+func (d *packDir) insert(fr *types.FileRange) error {
+	names := strings.Split(fr.DagPath, "/")
+	for _, name := range names[:len(names)-1] {
+		if _, ok := d.files[name]; ok {
+			return xerrors.Errorf("%s conflicts with file %s", fr.DagPath, name)
+		}
+		sub, ok := d.dirs[name]
+		if !ok {
+			sub = newPackDir()
+			d.dirs[name] = sub
+		}
+		d = sub
+	}
+
+	name := names[len(names)-1]
+	if _, ok := d.dirs[name]; ok {
+		return xerrors.Errorf("%s conflicts with a directory", fr.DagPath)
+	}
+	if _, ok := d.files[name]; ok {
+		return xerrors.Errorf("duplicate directory entry name %s", fr.DagPath)
+	}
+	d.files[name] = fr
+	return nil
+}
+
+// BuildRanges imports the source data ranges into a UnixFS directory tree laid out by their dag paths.
+func BuildRanges(ctx context.Context, ranges []*types.FileRange, into bstore.Blockstore, params types.DagParams, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
+	root := newPackDir()
+	for _, fr := range ranges {
+		if err := root.insert(fr); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	bsvc := blockservice.New(into, offline.Exchange(into))
+	dags := merkledag.NewDAGService(bsvc)
+
+	nd, err := buildPackDir(ctx, root, into, dags, params, msrv, parent)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+func buildPackDir(ctx context.Context, d *packDir, into bstore.Blockstore, dags ipld.DAGService, params types.DagParams, msrv *metaservice.MappingService, parent string) (ipld.Node, error) {
+	b := params.Prefix
+
+	// Directory nodes do not come from the source data, they are recorded through the DAGService.
+	dserv := dags
+	if msrv != nil {
+		dserv = msrv.GenerateDagService(dags)
+	}
+
+	dir := uio.NewDirectory(dserv)
+	dir.SetCidBuilder(b)
+
+	names := make([]string, 0, len(d.dirs)+len(d.files))
+	for name := range d.dirs {
+		names = append(names, name)
+	}
+	for name := range d.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var child ipld.Node
+		var err error
+		if sub, ok := d.dirs[name]; ok {
+			child, err = buildPackDir(ctx, sub, into, dags, params, msrv, parent)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			fr := d.files[name]
+			c, err := BuildRange(ctx, fr, into, params, msrv, parent)
+			if err != nil {
+				return nil, err
+			}
+			if child, err = dags.Get(ctx, c); err != nil {
+				return nil, xerrors.Errorf("failed to load file node %s: %w", fr.DagPath, err)
+			}
+		}
+
+		if err := dir.AddChild(ctx, name, child); err != nil {
+			return nil, xerrors.Errorf("failed to add %s to directory: %w", name, err)
+		}
+	}
+
+	nd, err := dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	if err := dserv.Add(ctx, nd); err != nil {
+		return nil, err
+	}
+
+	return nd, nil
+}
+
+// BuildRange imports a range of a regular file into the blockstore.
+func BuildRange(ctx context.Context, fr *types.FileRange, into bstore.Blockstore, params types.DagParams, msrv *metaservice.MappingService, parent string) (cid.Cid, error) {
+	srcPath := filepath.Join(parent, fr.Path)
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("failed to open input file: %w", err)
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("failed to stat file :%w", err)
+	}
+	if fr.Offset+fr.Size > uint64(stat.Size()) {
+		return cid.Undef, xerrors.Errorf("range %d+%d is beyond the end of %s", fr.Offset, fr.Size, srcPath)
+	}
+
+	reader := io.NopCloser(io.NewSectionReader(src, int64(fr.Offset), int64(fr.Size)))
+	file, err := files.NewReaderPathFile(srcPath, reader, stat)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("failed to create reader path file: %w", err)
+	}
+
+	return Build(ctx, file, into, true, srcPath, fr.Offset, params, msrv, parent)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/dataswap/go-metadata/libs"
+	metaservice "github.com/dataswap/go-metadata/service"
+	"github.com/dataswap/go-metadata/types"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/urfave/cli/v2"
+	"gotest.tools/assert"
+)
+
+func TestCreatePack(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	out := filepath.Join(dir, "out")
+	mappingPath := filepath.Join(dir, "mappings")
+	cachePath := filepath.Join(dir, "cache")
+	for _, path := range []string{filepath.Join(src, "sub"), out, mappingPath, cachePath} {
+		assert.NilError(t, os.MkdirAll(path, 0755))
+	}
+
+	// a file larger than the target size is split over several cars.
+	sizes := map[string]int{"large.bin": 3 << 20, "sub/medium.bin": 300 << 10, "small.txt": 5}
+	rnd := rand.New(rand.NewSource(1))
+	for name, size := range sizes {
+		data := make([]byte, size)
+		rnd.Read(data)
+		assert.NilError(t, os.WriteFile(filepath.Join(src, name), data, 0644))
+	}
+
+	app := &cli.App{Commands: []*cli.Command{createCmd}}
+	assert.NilError(t, app.Run([]string{"meta", "create", "pack", "--mapping-path", mappingPath, "--source-parent-path", dir,
+		"--cache-path", cachePath, "--target-size", "1MiB", "--chunker", "size-262144", src, out}))
+
+	buf, err := os.ReadFile(filepath.Join(out, "manifest.json"))
+	assert.NilError(t, err)
+	var manifest types.PackManifest
+	assert.NilError(t, json.Unmarshal(buf, &manifest))
+	assert.Equal(t, manifest.TargetSize, uint64(1<<20))
+	assert.Assert(t, len(manifest.Cars) > 3)
+	commPs, _ := metaservice.LoadSortCommp(cachePath)
+	assert.Equal(t, len(commPs), len(manifest.Cars))
+
+	capacity := manifest.TargetSize - manifest.TargetSize/128
+	ranges := make(map[string][]types.SrcData)
+	for _, cm := range manifest.Cars {
+		// the car is the piece of the manifest, within its capacity.
+		f, err := os.Open(filepath.Join(out, cm.Name))
+		assert.NilError(t, err)
+		rawCommP, pieceSize, err := metaservice.NewCommPCalculator().Sum(f)
+		f.Close()
+		assert.NilError(t, err)
+		pieceCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+		assert.NilError(t, err)
+		assert.Equal(t, pieceCid, cm.PieceCid)
+		assert.Equal(t, pieceSize, cm.PieceSize)
+		assert.Assert(t, cm.CarSize <= capacity, "car %s of %d bytes", cm.Name, cm.CarSize)
+		_, err = os.Stat(filepath.Join(mappingPath, cm.PieceCid.String()+metaservice.MAPPING_FILE_SUFFIX))
+		assert.NilError(t, err)
+
+		for _, fr := range cm.Files {
+			ranges[fr.Path] = append(ranges[fr.Path], fr.SrcData)
+		}
+	}
+
+	// every byte of the source files is packed exactly once.
+	assert.Equal(t, len(ranges), len(sizes))
+	for name, size := range sizes {
+		rs := ranges[filepath.Join("src", name)]
+		assert.Assert(t, len(rs) > 0, "%s is not packed", name)
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Offset < rs[j].Offset })
+		offset := uint64(0)
+		for _, r := range rs {
+			assert.Equal(t, r.Offset, offset, "range of %s", name)
+			offset += r.Size
+		}
+		assert.Equal(t, offset, uint64(size), "ranges of %s", name)
+	}
+	assert.Assert(t, len(ranges[filepath.Join("src", "large.bin")]) > 3)
+}
+
+func TestPackCarCapacity(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	mappingPath := filepath.Join(dir, "mappings")
+	cachePath := filepath.Join(dir, "cache")
+	for _, path := range []string{out, mappingPath, cachePath} {
+		assert.NilError(t, os.MkdirAll(path, 0755))
+	}
+	data := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "data.bin"), data, 0644))
+
+	prefix, err := CidBuilder(1, "sha2-256")
+	assert.NilError(t, err)
+	params := types.DagParams{Prefix: prefix, Chunker: "size-262144", Layout: libs.BalancedLayout, RawLeaves: true, MaxLinks: 174}
+	ranges := []*types.FileRange{{SrcData: types.SrcData{Path: "data.bin", Size: uint64(len(data))}, DagPath: "data.bin"}}
+
+	// a car over the capacity leaves no car, mapping file nor piece behind.
+	_, err = PackCar(context.Background(), ranges, out, params, uint64(len(data)), mappingPath, cachePath, dir)
+	assert.ErrorContains(t, err, "exceeds the piece capacity")
+	for _, path := range []string{out, mappingPath, cachePath} {
+		entries, err := os.ReadDir(path)
+		assert.NilError(t, err)
+		assert.Equal(t, len(entries), 0, "%s is not empty", path)
+	}
+
+	cm, err := PackCar(context.Background(), ranges, out, params, uint64(len(data))*2, mappingPath, cachePath, dir)
+	assert.NilError(t, err)
+	assert.Assert(t, cm.CarSize > uint64(len(data)))
+	_, err = os.Stat(filepath.Join(out, cm.Name))
+	assert.NilError(t, err)
+}
+
+func TestPackPlanner(t *testing.T) {
+	const chunkSize = 1 << 18
+	capacity := uint64(1 << 20)
+	p := newPackPlanner(capacity, chunkSize)
+	assert.NilError(t, p.Add("src/a.bin", "a.bin", 5<<20+7))
+	assert.NilError(t, p.Add("src/b.txt", "b.txt", 10))
+	cars := p.Cars()
+	assert.Assert(t, len(cars) > 5)
+
+	offset := uint64(0)
+	for _, ranges := range cars {
+		for _, fr := range ranges {
+			if fr.Path != "src/a.bin" {
+				continue
+			}
+			// a split file is split at chunk boundaries, so its leaves are the ones of a single DAG.
+			assert.Equal(t, fr.Offset, offset)
+			assert.Equal(t, fr.Offset%chunkSize, uint64(0))
+			offset += fr.Size
+		}
+	}
+	assert.Equal(t, offset, uint64(5<<20+7))
+
+	// a capacity below a single chunk packs nothing.
+	assert.ErrorContains(t, newPackPlanner(chunkSize/2, chunkSize).Add("src/a.bin", "a.bin", chunkSize*2), "is too small")
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"strconv"
 
 	metaservice "github.com/dataswap/go-metadata/service"
+	"github.com/dataswap/go-metadata/utils"
+	"github.com/ipfs/go-cid"
 	"github.com/urfave/cli/v2"
 
 	"golang.org/x/xerrors"
@@ -15,6 +19,8 @@ var proofCmd = &cli.Command{
 	Subcommands: []*cli.Command{
 		challengeProofCmd,
 		datasetProofCmd,
+		aggregateProofCmd,
+		rangeProofCmd,
 	},
 }
 
@@ -31,12 +37,12 @@ var challengeProofCmd = &cli.Command{
 		},
 		&cli.StringFlag{
 			Name:     "source-parent-path",
-			Usage:    "The source file",
+			Usage:    "The source data parent path, a local directory, an http(s):// URL or an s3://bucket/prefix URI",
 			Required: true,
 		},
 		&cli.BoolFlag{
 			Name:  "raw-leaves",
-			Usage: "The raw leaves",
+			Usage: "The raw leaves, only used for mapping files without recorded DAG parameters",
 			Value: false,
 		},
 	},
@@ -51,15 +57,21 @@ func challengeProof(c *cli.Context) error {
 	randomness, _ := strconv.ParseUint(c.Args().First(), 10, 64)
 	cachePath := c.Args().Get(1)
 
-	metaservice.MappingServiceInstance(
+	// the source reader is shared by all the challenged chunks.
+	source, err := metaservice.NewSourceReader(c.String("source-parent-path"))
+	if err != nil {
+		return err
+	}
+	provider := metaservice.NewMappingChunkProvider(
 		metaservice.MetaPath(c.String("meta-path")),
 		metaservice.SourceParentPath(c.String("source-parent-path")),
+		metaservice.Source(source),
 		metaservice.RawLeaves(c.Bool("raw-leaves")),
 	)
 
 	log.Info("\r\nrandomness: ", randomness)
 
-	_, err := metaservice.GenChallengeProof(randomness, cachePath)
+	_, err = metaservice.GenChallengeProof(randomness, cachePath, provider)
 	if err != nil {
 		return err
 	}
@@ -94,3 +106,145 @@ func datasetProof(c *cli.Context) error {
 
 	return nil
 }
+
+var aggregateProofCmd = &cli.Command{
+	Name:      "aggregate-proof",
+	Usage:     "compute aggregate piece of the cars and the inclusion proofs of commPs",
+	ArgsUsage: "<cachePath>",
+	Action:    aggregateProof,
+	Flags: []cli.Flag{
+		&cli.Uint64Flag{
+			Name:  "deal-size",
+			Usage: "The padded size of the aggregate piece, 0 is the smallest piece the cars fit in",
+			Value: 0,
+		},
+	},
+}
+
+// aggregateProof is a command to aggregate the cars per FRC-0058 and compute the inclusion proofs of commps.
+func aggregateProof(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return xerrors.Errorf("Args must be specified 1 nums!")
+	}
+
+	cachePath := c.Args().First()
+
+	aggregate, err := metaservice.GenAggregateProof(cachePath, c.Uint64("deal-size"))
+	if err != nil {
+		return err
+	}
+
+	bl, err := metaservice.VerifyAggregateProof(cachePath)
+	if err != nil {
+		return err
+	}
+	if !bl {
+		return xerrors.Errorf("inclusion proofs of the aggregate do not verify")
+	}
+
+	pieceCid, err := aggregate.PieceCid()
+	if err != nil {
+		return err
+	}
+	log.Info("aggregate piece: ", pieceCid, " size: ", aggregate.DealSize, " segments: ", len(aggregate.Segments))
+
+	return nil
+}
+
+var rangeProofCmd = &cli.Command{
+	Name:      "range-proof",
+	Usage:     "compute inclusion proof of a byte range of a car in its piece",
+	ArgsUsage: "<pieceCid> <cachePath>",
+	Action:    rangeProof,
+	Flags: []cli.Flag{
+		&cli.Uint64Flag{
+			Name:     "offset",
+			Usage:    "The offset of the range in the car",
+			Required: true,
+		},
+		&cli.Uint64Flag{
+			Name:     "length",
+			Usage:    "The length of the range",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Usage:    "The range proof file to write to",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "car",
+			Usage: "The car file, otherwise the car is rebuilt from the meta file and the source data",
+		},
+		&cli.StringFlag{
+			Name:  "meta-path",
+			Usage: "The meta file",
+		},
+		&cli.StringFlag{
+			Name:  "source-parent-path",
+			Usage: "The source data parent path, a local directory, an http(s):// URL or an s3://bucket/prefix URI",
+		},
+		&cli.BoolFlag{
+			Name:  "raw-leaves",
+			Usage: "The raw leaves, only used for mapping files without recorded DAG parameters",
+			Value: false,
+		},
+	},
+}
+
+// rangeProof is a command to compute the proof of a byte range of a car against its piece CID.
+func rangeProof(c *cli.Context) error {
+	if c.Args().Len() != 2 {
+		return xerrors.Errorf("Args must be specified 2 nums!")
+	}
+
+	pieceCid, err := cid.Parse(c.Args().First())
+	if err != nil {
+		return err
+	}
+	cacheFile := filepath.Join(c.Args().Get(1), pieceCid.String()+metaservice.CACHE_SUFFIX)
+
+	var provider metaservice.ChunkProvider
+	if c.IsSet("car") {
+		f, err := os.Open(c.String("car"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		provider = metaservice.NewCarChunkProvider(f)
+	} else {
+		if !c.IsSet("meta-path") || !c.IsSet("source-parent-path") {
+			return xerrors.Errorf("--car or --meta-path and --source-parent-path must be specified")
+		}
+		source, err := metaservice.NewSourceReader(c.String("source-parent-path"))
+		if err != nil {
+			return err
+		}
+		provider = metaservice.NewMappingChunkProvider(
+			metaservice.MetaPath(c.String("meta-path")),
+			metaservice.SourceParentPath(c.String("source-parent-path")),
+			metaservice.Source(source),
+			metaservice.RawLeaves(c.Bool("raw-leaves")),
+		)
+	}
+
+	offset, length := c.Uint64("offset"), c.Uint64("length")
+	proof, err := metaservice.GenRangeProof(cacheFile, pieceCid, offset, length, provider)
+	if err != nil {
+		return err
+	}
+
+	data, err := provider.GetChunk(pieceCid, offset, length)
+	if err != nil {
+		return err
+	}
+	bl, err := metaservice.VerifyRangeProof(data, proof, pieceCid)
+	if err != nil {
+		return err
+	}
+	if !bl {
+		return xerrors.Errorf("range proof of %d+%d does not verify against %s", offset, length, pieceCid)
+	}
+
+	return utils.WriteJson(c.String("output"), "\t", proof)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	metaservice "github.com/dataswap/go-metadata/service"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var regenerateCmd = &cli.Command{
+	Name:      "regenerate",
+	Usage:     "Rebuild a car from its mapping file and the source data and check it against its piece CID",
+	ArgsUsage: "<mappingFile> [<outputPath>]",
+	Description: "The car is rebuilt bit-for-bit from the mappings and its commP is recomputed. The command fails\n" +
+		"   unless the commP matches the piece CID, by default the one the mapping file is named by.\n" +
+		"   Without an outputPath the car is only checked.",
+	Action: regenerate,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "source-parent-path",
+			Usage:    "The source data parent path, a local directory, an http(s):// URL or an s3://bucket/prefix URI",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "piece-cid",
+			Usage: "The expected piece CID, the name of the mapping file if not set",
+		},
+	},
+}
+
+// regenerate is a command to rebuild a car and check its commP.
+func regenerate(c *cli.Context) error {
+	if c.Args().Len() != 1 && c.Args().Len() != 2 {
+		return xerrors.Errorf("Args must be specified 1 or 2 nums!")
+	}
+
+	mappingPath := c.Args().First()
+	outPath := c.Args().Get(1)
+
+	expected, err := expectedPieceCid(mappingPath, c.String("piece-cid"))
+	if err != nil {
+		return err
+	}
+
+	msrv := metaservice.New()
+	if err := msrv.LoadMetaMappings(mappingPath); err != nil {
+		return err
+	}
+	cw, err := metaservice.RegenerateCar(msrv, c.String("source-parent-path"), expected, outPath)
+	if err != nil {
+		return err
+	}
+	commCid, _ := cw.PieceCid()
+	_, pieceSize, _ := cw.Sum()
+
+	log.Info("\nPiece CID: ", commCid.String(), "\npieceSize: ", pieceSize, "\ncarSize: ", cw.Size())
+	return nil
+}
+
+// expectedPieceCid parses pieceCid, or else the name of the mapping file.
+func expectedPieceCid(mappingPath string, pieceCid string) (cid.Cid, error) {
+	if pieceCid == "" {
+		name := filepath.Base(mappingPath)
+		pieceCid = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	c, err := cid.Parse(pieceCid)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("invalid piece CID %q, use --piece-cid: %w", pieceCid, err)
+	}
+	return c, nil
+}
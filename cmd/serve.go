@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metaservice "github.com/dataswap/go-metadata/service"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var serveCmd = &cli.Command{
+	Name:  "serve",
+	Usage: "Serve pieces and cars rebuilt from the mapping files and the source data over HTTP",
+	Description: "GET /piece/<pieceCid> serves the piece data, the car followed by the zero padding of the piece.\n" +
+		"   GET /car/<rootCid> serves the car. Both support range requests, the bytes are rebuilt on the fly.",
+	Action: serve,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "meta-path",
+			Usage:    "The directory of the mapping files, named by the piece CIDs",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "source-parent-path",
+			Usage:    "The source data parent path, a local directory, an http(s):// URL or an s3://bucket/prefix URI",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Usage: "The address to listen on",
+			Value: ":8080",
+		},
+	},
+}
+
+// serve is a command to serve the pieces of the mapping files.
+func serve(c *cli.Context) error {
+	source, err := metaservice.NewSourceReader(c.String("source-parent-path"))
+	if err != nil {
+		return err
+	}
+
+	srv, err := newPieceServer(c.String("meta-path"), source)
+	if err != nil {
+		return err
+	}
+	log.Infof("serving %d pieces on %s", len(srv.pieces), c.String("listen"))
+
+	return http.ListenAndServe(c.String("listen"), srv)
+}
+
+// servedCar is a car rebuilt from the mapping file of a piece.
+type servedCar struct {
+	car       *metaservice.VirtualCar
+	carSize   uint64
+	pieceSize uint64 // unpadded size of the piece
+}
+
+// ReadAt reads the car followed by the zero padding of the piece.
+func (s *servedCar) ReadAt(p []byte, off int64) (int, error) {
+	n, err := s.car.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	for i := n; i < len(p) && uint64(off)+uint64(i) < s.pieceSize; i++ {
+		p[i] = 0
+		n++
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// pieceServer serves the pieces and cars of the mapping files of a directory.
+type pieceServer struct {
+	pieces map[cid.Cid]*servedCar
+	cars   map[cid.Cid]*servedCar
+}
+
+// newPieceServer loads the mapping files of metaPath, binary mapping files are preferred over json ones.
+func newPieceServer(metaPath string, source metaservice.SourceReader) (*pieceServer, error) {
+	entries, err := os.ReadDir(metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &pieceServer{
+		pieces: make(map[cid.Cid]*servedCar),
+		cars:   make(map[cid.Cid]*servedCar),
+	}
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if e.IsDir() || ext != metaservice.MAPPING_BINARY_FILE_SUFFIX && ext != metaservice.MAPPING_FILE_SUFFIX {
+			continue
+		}
+		pieceCid, err := cid.Parse(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+		// the entries are sorted by name, the binary mapping file of a piece is loaded before the json one.
+		if _, ok := srv.pieces[pieceCid]; ok && ext == metaservice.MAPPING_FILE_SUFFIX {
+			continue
+		}
+
+		ms := metaservice.New(metaservice.Source(source))
+		if err := ms.LoadMetaMappings(filepath.Join(metaPath, name)); err != nil {
+			return nil, xerrors.Errorf("failed to load mapping file %s: %w", name, err)
+		}
+		vc, err := metaservice.NewVirtualCar(ms, "")
+		if err != nil {
+			return nil, err
+		}
+		carSize := uint64(vc.Size())
+
+		sc := &servedCar{
+			car:       vc,
+			carSize:   carSize,
+			pieceSize: metaservice.PaddedPieceSize(carSize) / metaservice.SLAB_CHUNK_SIZE * metaservice.SOURCE_CHUNK_SIZE,
+		}
+		srv.pieces[pieceCid] = sc
+		srv.cars[ms.DataRoot()] = sc
+	}
+
+	return srv, nil
+}
+
+func (s *pieceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sc *servedCar
+	var size uint64
+	var contentType string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/piece/"):
+		if c, err := cid.Parse(strings.TrimPrefix(r.URL.Path, "/piece/")); err == nil {
+			sc = s.pieces[c]
+		}
+		if sc != nil {
+			size, contentType = sc.pieceSize, "application/octet-stream"
+		}
+	case strings.HasPrefix(r.URL.Path, "/car/"):
+		if c, err := cid.Parse(strings.TrimPrefix(r.URL.Path, "/car/")); err == nil {
+			sc = s.cars[c]
+		}
+		if sc != nil {
+			size, contentType = sc.carSize, "application/vnd.ipld.car"
+		}
+	}
+	if sc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(sc, 0, int64(size)))
+}
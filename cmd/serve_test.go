@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	metaservice "github.com/dataswap/go-metadata/service"
+	"github.com/urfave/cli/v2"
+	"gotest.tools/assert"
+)
+
+// get requests url with the range header if set, it returns the status and the body of the response.
+func get(t *testing.T, method string, url string, rng string) (int, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	assert.NilError(t, err)
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NilError(t, err)
+	return resp.StatusCode, body
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	mappingPath := filepath.Join(dir, "mappings")
+	cachePath := filepath.Join(dir, "cache")
+	for _, path := range []string{src, mappingPath, cachePath} {
+		assert.NilError(t, os.MkdirAll(path, 0755))
+	}
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "large.bin"), data, 0644))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "small.txt"), []byte("small"), 0644))
+
+	app := &cli.App{Commands: []*cli.Command{createCmd}}
+	carPath := filepath.Join(dir, "out.car")
+	assert.NilError(t, app.Run([]string{"meta", "create", "car", "--mapping-path", mappingPath, "--source-parent-path", dir,
+		"--cache-path", cachePath, src, carPath}))
+	carBuf, err := os.ReadFile(carPath)
+	assert.NilError(t, err)
+
+	names, err := filepath.Glob(filepath.Join(mappingPath, "*"+metaservice.MAPPING_FILE_SUFFIX))
+	assert.NilError(t, err)
+	assert.Equal(t, len(names), 1)
+	pieceCid := strings.TrimSuffix(filepath.Base(names[0]), metaservice.MAPPING_FILE_SUFFIX)
+
+	// the binary mapping file is served, the json one next to it is not loaded.
+	ms := metaservice.New()
+	assert.NilError(t, ms.LoadMetaMappings(names[0]))
+	root := ms.DataRoot()
+	assert.NilError(t, ms.SaveBinaryMetaMappings(mappingPath, pieceCid+metaservice.MAPPING_BINARY_FILE_SUFFIX))
+	assert.NilError(t, os.WriteFile(names[0], []byte("{"), 0644))
+
+	source, err := metaservice.NewSourceReader(dir)
+	assert.NilError(t, err)
+	srv, err := newPieceServer(mappingPath, source)
+	assert.NilError(t, err)
+	assert.Equal(t, len(srv.pieces), 1)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	carSize := uint64(len(carBuf))
+	pieceSize := metaservice.PaddedPieceSize(carSize) / metaservice.SLAB_CHUNK_SIZE * metaservice.SOURCE_CHUNK_SIZE
+	piece := append(append([]byte{}, carBuf...), make([]byte, pieceSize-carSize)...)
+
+	status, body := get(t, http.MethodGet, ts.URL+"/car/"+root.String(), "")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Assert(t, bytes.Equal(body, carBuf), "the served car differs from the car")
+
+	status, body = get(t, http.MethodGet, ts.URL+"/piece/"+pieceCid, "")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Assert(t, bytes.Equal(body, piece), "the served piece differs from the padded car")
+
+	for _, c := range []struct {
+		name       string
+		start, end uint64
+	}{
+		{"straddling the end of the car", carSize - 100, carSize + 99},
+		{"in the padding", carSize + 10, carSize + 1000},
+		{"up to the end of the piece", carSize + 1, pieceSize - 1},
+		{"in the car", 1000, 200000},
+	} {
+		status, body = get(t, http.MethodGet, ts.URL+"/piece/"+pieceCid, fmt.Sprintf("bytes=%d-%d", c.start, c.end))
+		assert.Equal(t, status, http.StatusPartialContent, c.name)
+		assert.Assert(t, bytes.Equal(body, piece[c.start:c.end+1]), "range %s differs from the padded car", c.name)
+	}
+
+	// the car is not padded.
+	status, _ = get(t, http.MethodGet, ts.URL+"/car/"+root.String(), fmt.Sprintf("bytes=%d-", carSize))
+	assert.Equal(t, status, http.StatusRequestedRangeNotSatisfiable)
+	status, _ = get(t, http.MethodGet, ts.URL+"/piece/"+pieceCid, fmt.Sprintf("bytes=%d-", pieceSize))
+	assert.Equal(t, status, http.StatusRequestedRangeNotSatisfiable)
+
+	// unknown pieces and cars, the root is not a piece and the piece is not a car.
+	for _, path := range []string{
+		"/piece/baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq",
+		"/piece/" + root.String(),
+		"/car/" + pieceCid,
+		"/piece/invalid",
+		"/" + pieceCid,
+	} {
+		status, _ = get(t, http.MethodGet, ts.URL+path, "")
+		assert.Equal(t, status, http.StatusNotFound, path)
+	}
+	status, _ = get(t, http.MethodPost, ts.URL+"/car/"+root.String(), "")
+	assert.Equal(t, status, http.StatusMethodNotAllowed)
+}
@@ -1,19 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
 
 	metaservice "github.com/dataswap/go-metadata/service"
+	"github.com/dustin/go-humanize"
 	commcid "github.com/filecoin-project/go-fil-commcid"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-car"
 	"github.com/urfave/cli/v2"
-
-	"github.com/ipld/go-car/v2/blockstore"
-	ipldprime "github.com/ipld/go-ipld-prime"
-	basicnode "github.com/ipld/go-ipld-prime/node/basic"
-	"github.com/ipld/go-ipld-prime/traversal/selector"
-	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"golang.org/x/xerrors"
 )
 
@@ -23,6 +22,8 @@ var toolsCmd = &cli.Command{
 		commpCmd,
 		dumpCmd,
 		dumpChallengesProofCmd,
+		mappingToBinaryCmd,
+		mappingToJsonCmd,
 	},
 }
 
@@ -30,51 +31,90 @@ var commpCmd = &cli.Command{
 	Name:      "commp",
 	Usage:     "compute commp CID(PieceCID)",
 	ArgsUsage: "<inputCarPath> <inputCarRoot> <cachePath>",
-	Action:    commpCar,
+	Description: "The car is hashed as it is, inputCarRoot must be the root of its header.\n" +
+		"   The level cache of the car is stored under cachePath and the piece is registered in its rawCommP.cache,\n" +
+		"   which the dataset and challenge proofs are generated from.\n" +
+		"   With --target-size the commP padded to the target size, e.g. the sector size, is output as well. It is only printed,\n" +
+		"   the registered piece is the one of the car, whose level cache the challenge proofs are generated from.",
+	Action: commpCar,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "target-size",
+			Usage: "The padded piece size to pad the commP to, must be a power of two, e.g. 32GiB",
+		},
+	},
 }
 
-// commpCar is a command to output the commp cid in a car.
+// commpCar is a command to output the commp cid in a car and register it in the dataset cache.
 func commpCar(c *cli.Context) error {
-	if c.Args().Len() != 2 && c.Args().Len() != 5 {
-		return xerrors.Errorf("Args must be specified 2 or 5 nums!")
+	if c.Args().Len() != 3 {
+		return xerrors.Errorf("Args must be specified 3 nums!")
 	}
 
-	bs, err := blockstore.OpenReadOnly(c.Args().First())
+	f, err := os.Open(c.Args().First())
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	cid, err := cid.Parse(c.Args().Get(1))
+	root, err := cid.Parse(c.Args().Get(1))
 	if err != nil {
 		return err
 	}
+	header, err := car.ReadHeader(bufio.NewReader(f))
+	if err != nil {
+		return xerrors.Errorf("failed to read the car header: %w", err)
+	}
+	if len(header.Roots) != 1 || !header.Roots[0].Equals(root) {
+		return xerrors.Errorf("%s is not the root of the car, its roots are %v", root, header.Roots)
+	}
 
 	cachePath := c.Args().Get(2)
 
-	selector := allSelector()
-	sc := car.NewSelectiveCar(c.Context, bs, []car.Dag{{Root: cid, Selector: selector}})
+	var targetSize uint64
+	if c.IsSet("target-size") {
+		if targetSize, err = humanize.ParseBytes(c.String("target-size")); err != nil {
+			return xerrors.Errorf("failed to parse target size: %w", err)
+		}
+		if bits.OnesCount64(targetSize) != 1 || targetSize > metaservice.MaxPieceSize {
+			return xerrors.Errorf("target size %d is not a power of two up to %d", targetSize, metaservice.MaxPieceSize)
+		}
+	}
 
-	buf := bytes.Buffer{}
-	sc.Write(&buf)
+	// the car is hashed as it is, its blocks are in the order it was written in, as create car records them.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cw := metaservice.NewCommPWriter()
+	if _, err := io.Copy(cw, f); err != nil {
+		return xerrors.Errorf("failed to hash the car: %w", err)
+	}
 
-	rawCommP, pieceSize, err := metaservice.GenCommP(buf, cachePath, 0)
+	commCid, err := SavePiece(cw, cachePath)
 	if err != nil {
 		return err
 	}
-	commCid, _ := commcid.DataCommitmentV1ToCID(rawCommP)
-
-	log.Info("\nCommP Cid: ", commCid.String(), "\npieceSize: ", pieceSize)
+	rawCommP, pieceSize, _ := cw.Sum()
+
+	log.Info("\nCommP Cid: ", commCid.String(), "\npieceSize: ", pieceSize, "\ncarSize: ", cw.Size())
+
+	if targetSize != 0 {
+		// the commP is padded as by the targetPaddedSize of GenCommP, which holds the whole car in memory.
+		// the registered piece is the one of the car, its level cache is the one the challenge proofs use.
+		paddedCommP, err := metaservice.PadCommP(rawCommP, pieceSize, targetSize)
+		if err != nil {
+			return err
+		}
+		paddedCid, err := commcid.DataCommitmentV1ToCID(paddedCommP)
+		if err != nil {
+			return err
+		}
+		log.Info("\nPadded CommP Cid: ", paddedCid.String(), "\npaddedPieceSize: ", targetSize)
+	}
 
 	return nil
 }
 
-func allSelector() ipldprime.Node {
-	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
-	return ssb.ExploreRecursive(selector.RecursionLimitNone(),
-		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).
-		Node()
-}
-
 var dumpCmd = &cli.Command{
 	Name:      "dump",
 	Usage:     "dump commp info",
@@ -90,18 +130,6 @@ func dump(c *cli.Context) error {
 
 	cachePath := c.Args().First()
 
-	// rawCommP := [][]byte{
-	// 	[]byte("aaaa"),
-	// 	[]byte("bbbb"),
-	// 	[]byte("cccc"),
-	// 	[]byte("dddd"),
-	// }
-
-	// metaservice.SaveCommP(rawCommP[0], uint64(66), cachePath)
-	// metaservice.SaveCommP(rawCommP[1], uint64(6677), cachePath)
-	// metaservice.SaveCommP(rawCommP[2], uint64(6688), cachePath)
-	// metaservice.SaveCommP(rawCommP[3], uint64(6699), cachePath)
-
 	commP, carSize := metaservice.LoadSortCommp(cachePath)
 
 	if commP == nil {
@@ -134,3 +162,36 @@ func dumpChallengesProof(c *cli.Context) error {
 	log.Info("\nproofs: ", proofs)
 	return nil
 }
+
+var mappingToBinaryCmd = &cli.Command{
+	Name:      "mapping-to-binary",
+	Usage:     "convert a json mapping file to the binary mapping format",
+	ArgsUsage: "<jsonMappingPath> <binaryMappingPath>",
+	Action: func(c *cli.Context) error {
+		return convertMapping(c, (*metaservice.MappingService).SaveBinaryMetaMappings)
+	},
+}
+
+var mappingToJsonCmd = &cli.Command{
+	Name:      "mapping-to-json",
+	Usage:     "convert a binary mapping file to the json mapping format",
+	ArgsUsage: "<binaryMappingPath> <jsonMappingPath>",
+	Action: func(c *cli.Context) error {
+		return convertMapping(c, (*metaservice.MappingService).SaveMetaMappings)
+	},
+}
+
+// convertMapping is a command to load a mapping file and save it in another format.
+func convertMapping(c *cli.Context, save func(ms *metaservice.MappingService, path string, name string) error) error {
+	if c.Args().Len() != 2 {
+		return xerrors.Errorf("Args must be specified 2 nums!")
+	}
+
+	msrv := metaservice.New()
+	if err := msrv.LoadMetaMappings(c.Args().First()); err != nil {
+		return err
+	}
+
+	outPath := c.Args().Get(1)
+	return save(msrv, filepath.Dir(outPath), filepath.Base(outPath))
+}
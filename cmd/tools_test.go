@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metaservice "github.com/dataswap/go-metadata/service"
+	"github.com/ipld/go-car"
+	"github.com/urfave/cli/v2"
+	"gotest.tools/assert"
+)
+
+// levelCaches returns the names of the level cache files of the pieces under cachePath.
+func levelCaches(t *testing.T, cachePath string) []string {
+	names, err := filepath.Glob(filepath.Join(cachePath, "baga*"+metaservice.CACHE_SUFFIX))
+	assert.NilError(t, err)
+	return names
+}
+
+func TestCommpCreatedCar(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	mappingPath := filepath.Join(dir, "mappings")
+	cachePath := filepath.Join(dir, "cache")
+	for _, path := range []string{src, mappingPath, cachePath} {
+		assert.NilError(t, os.MkdirAll(path, 0755))
+	}
+
+	// a file of several leaves in a directory, the car of create car holds the children before their parents.
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "large.bin"), data, 0644))
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "small.txt"), []byte("small"), 0644))
+
+	app := &cli.App{Commands: []*cli.Command{createCmd, toolsCmd}}
+	carPath := filepath.Join(dir, "out.car")
+	assert.NilError(t, app.Run([]string{"meta", "create", "car", "--mapping-path", mappingPath, "--source-parent-path", dir,
+		"--cache-path", cachePath, src, carPath}))
+	commPs, carSizes := metaservice.LoadSortCommp(cachePath)
+	assert.Equal(t, len(commPs), 1)
+	caches := levelCaches(t, cachePath)
+	assert.Equal(t, len(caches), 1)
+
+	f, err := os.Open(carPath)
+	assert.NilError(t, err)
+	defer f.Close()
+	header, err := car.ReadHeader(bufio.NewReader(f))
+	assert.NilError(t, err)
+
+	// the piece of the same car is registered once.
+	assert.NilError(t, app.Run([]string{"meta", "tools", "commp", carPath, header.Roots[0].String(), cachePath}))
+	commpCommPs, commpCarSizes := metaservice.LoadSortCommp(cachePath)
+	assert.DeepEqual(t, commpCommPs, commPs)
+	assert.DeepEqual(t, commpCarSizes, carSizes)
+	assert.DeepEqual(t, levelCaches(t, cachePath), caches)
+
+	// another root is not the one of the car.
+	err = app.Run([]string{"meta", "tools", "commp", carPath, "bafkqaaa", cachePath})
+	assert.ErrorContains(t, err, "is not the root of the car")
+}
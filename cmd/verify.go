@@ -1,7 +1,14 @@
 package main
 
 import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
 	metaservice "github.com/dataswap/go-metadata/service"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/ipfs/go-cid"
 	"github.com/urfave/cli/v2"
 
 	"golang.org/x/xerrors"
@@ -12,6 +19,9 @@ var verifyCmd = &cli.Command{
 	Usage:     "verify challenge proofs of merkle-tree",
 	ArgsUsage: "<cachePath>",
 	Action:    verify,
+	Subcommands: []*cli.Command{
+		verifyCacheCmd,
+	},
 }
 
 // verify is a command to verify challenge proofs of merkle-tree.
@@ -30,3 +40,106 @@ func verify(c *cli.Context) error {
 	log.Info("\nverify: ", bl)
 	return nil
 }
+
+var verifyCacheCmd = &cli.Command{
+	Name:      "cache",
+	Usage:     "verify a level cache file against the car of its piece",
+	ArgsUsage: "[<car>] <cache>",
+	Description: "The cached layers are recomputed from the car, or from the mapping file and the source data without\n" +
+		"   a car, and the first mismatching subtree is reported with the range of the car under it. With --root-only\n" +
+		"   the car is not read, the cached layers are only checked to hash to the piece CID.\n" +
+		"   The piece CID is by default the name of the cache file, a piece CID or the hex of the commP.",
+	Action: verifyCache,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "root-only",
+			Usage: "Only check the cached layers hash to the piece CID, without the car",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:  "piece-cid",
+			Usage: "The expected piece CID, the name of the cache file if not set",
+		},
+		&cli.StringFlag{
+			Name:  "mapping-file",
+			Usage: "The mapping file to rebuild the car from, instead of a car",
+		},
+		&cli.StringFlag{
+			Name:  "source-parent-path",
+			Usage: "The source data parent path of the mapping file, a local directory, an http(s):// URL or an s3://bucket/prefix URI, required with --mapping-file",
+		},
+	},
+}
+
+// verifyCache is a command to verify a level cache file against its car and piece CID.
+func verifyCache(c *cli.Context) error {
+	// the car is not read with --root-only, nor with --mapping-file which rebuilds it.
+	withoutCar := c.Bool("root-only") || c.IsSet("mapping-file")
+	if withoutCar && c.Args().Len() != 1 {
+		return xerrors.Errorf("Args must be specified 1 num with --root-only or --mapping-file!")
+	}
+	if !withoutCar && c.Args().Len() != 2 {
+		return xerrors.Errorf("Args must be specified 2 nums!")
+	}
+	// source paths would be resolved against the working directory, the mismatch reported would be a wrong one.
+	if c.IsSet("mapping-file") && !c.IsSet("source-parent-path") {
+		return xerrors.Errorf("--source-parent-path must be specified with --mapping-file")
+	}
+
+	cacheFile := c.Args().Get(c.Args().Len() - 1)
+	pieceCid, err := cachePieceCid(cacheFile, c.String("piece-cid"))
+	if err != nil {
+		return err
+	}
+	commP, err := commcid.CIDToDataCommitmentV1(pieceCid)
+	if err != nil {
+		return err
+	}
+
+	var m *metaservice.CacheMismatch
+	if c.Bool("root-only") {
+		m, err = metaservice.VerifyLevelCacheRoot(cacheFile, commP)
+	} else {
+		var car io.Reader
+		if c.IsSet("mapping-file") {
+			msrv := metaservice.New()
+			if err := msrv.LoadMetaMappings(c.String("mapping-file")); err != nil {
+				return err
+			}
+			vc, err := metaservice.NewVirtualCar(msrv, c.String("source-parent-path"))
+			if err != nil {
+				return err
+			}
+			car = vc
+		} else {
+			f, err := os.Open(c.Args().First())
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			car = f
+		}
+		m, err = metaservice.VerifyLevelCache(cacheFile, car, commP)
+	}
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		return xerrors.Errorf("level cache %s does not match the piece %s: %s", cacheFile, pieceCid, m)
+	}
+
+	log.Info("\nverify: true\npiece CID: ", pieceCid)
+	return nil
+}
+
+// cachePieceCid parses pieceCid, or else the name of the cache file, level caches are named by their piece CID.
+func cachePieceCid(cacheFile string, pieceCid string) (cid.Cid, error) {
+	if pieceCid == "" {
+		pieceCid = strings.TrimSuffix(filepath.Base(cacheFile), metaservice.CACHE_SUFFIX)
+	}
+	c, err := cid.Parse(pieceCid)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("invalid piece CID %q, use --piece-cid: %w", pieceCid, err)
+	}
+	return c, nil
+}
@@ -1,14 +1,48 @@
 package libs
 
 import (
+	"bytes"
 	"io"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	chunker "github.com/ipfs/go-ipfs-chunker"
 )
 
 const UnixfsChunkSize uint64 = 1 << 20 //Deafault chunksize 2M
 
+const DefaultChunker = "size-1048576" //Size splitter of UnixfsChunkSize
+
+const buzhashMinChunkSize uint64 = 128 << 10 //Smallest chunk of the buzhash splitter
+
+// MinChunkSize returns the size of the smallest chunk the chunker spec splits a file into, besides its last chunk.
+func MinChunkSize(spec string) (uint64, error) {
+	if _, err := chunker.FromString(bytes.NewReader(nil), spec); err != nil {
+		return 0, err
+	}
+
+	parts := strings.Split(spec, "-")
+	switch {
+	case spec == "" || spec == "default":
+		return uint64(chunker.DefaultBlockSize), nil
+	case parts[0] == "size":
+		return strconv.ParseUint(parts[1], 10, 64)
+	case parts[0] == "rabin" && len(parts) == 1:
+		return uint64(chunker.DefaultBlockSize) / 3, nil
+	case parts[0] == "rabin" && len(parts) == 2:
+		// the rabin splitter of an average size cuts chunks of a third of it at least.
+		avg, err := strconv.ParseUint(parts[1], 10, 64)
+		return avg / 3, err
+	case parts[0] == "rabin":
+		// the minimum may be labeled as min:<bytes>.
+		sub := strings.Split(parts[1], ":")
+		return strconv.ParseUint(sub[len(sub)-1], 10, 64)
+	default:
+		return buzhashMinChunkSize, nil
+	}
+}
+
 // Reading data while obtaining source data information, including the source data file path, offset, and size:
 type SliceMeta struct {
 	Path   string
@@ -31,12 +65,17 @@ type sliceSplitter struct {
 	chunkStart uint64
 }
 
-func NewSplitter(r io.Reader, size int64, srcPath string, parentPath string, chunkStart uint64) (EnhancedSplitter, error) {
+// NewSplitter creates an EnhancedSplitter of the chunker spec accepted by chunker.FromString,
+// "size-<bytes>", "rabin[-<min>-<avg>-<max>]" or "buzhash".
+func NewSplitter(r io.Reader, spec string, srcPath string, parentPath string, chunkStart uint64) (EnhancedSplitter, error) {
 	path, err := filepath.Rel(filepath.Clean(parentPath), filepath.Clean(srcPath))
 	if err != nil {
 		return nil, err
 	}
-	spl := chunker.NewSizeSplitter(r, size)
+	spl, err := chunker.FromString(r, spec)
+	if err != nil {
+		return nil, err
+	}
 	return &sliceSplitter{
 		Splitter:   spl,
 		srcPath:    path,
@@ -73,11 +73,31 @@ func (w *WrapDagBuilder) NewLeafDataNode(fsNodeType pb.Data_DataType) (node ipld
 	return node, dataSize, nil
 }
 
+// Rewrite 'FillNodeLayer' so the leaves of trickle DAGs are created by the 'NewLeafDataNode' of the wrapper.
+func (w *WrapDagBuilder) FillNodeLayer(node *helpers.FSNodeOverDag) error {
+	// while we have room AND we're not done
+	for node.NumChildren() < w.Maxlinks() && !w.Done() {
+		child, childFileSize, err := w.NewLeafDataNode(pb.Data_Raw)
+		if err != nil {
+			return err
+		}
+
+		if err := node.AddChild(child, childFileSize, w); err != nil {
+			return err
+		}
+	}
+	_, err := node.Commit()
+	return err
+}
+
 // Rewrite the 'Add' method to invoke a callback function to pass back the mapping information of the node.
+// Leaves are added right after they are created, so their cached 'SliceMeta' is released once passed back.
 func (w *WrapDagBuilder) Add(node ipld.Node) error {
-	w.lk.RLock()
-	defer w.lk.RUnlock()
-	if meta, ok := w.metas[node.Cid()]; ok {
+	w.lk.Lock()
+	meta, ok := w.metas[node.Cid()]
+	delete(w.metas, node.Cid())
+	w.lk.Unlock()
+	if ok {
 		w.hcb(node, meta.Path, meta.Offset, meta.Size)
 	}
 
@@ -0,0 +1,77 @@
+package libs
+
+import (
+	"fmt"
+
+	ipld "github.com/ipfs/go-ipld-format"
+	ft "github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+)
+
+const (
+	BalancedLayout = "balanced"
+	TrickleLayout  = "trickle"
+)
+
+const UnixfsLinksPerLevel = 1024 //Default maximum number of links of a DAG node
+
+// depthRepeat is the number of subtrees of a given depth in a trickle DAG node, as in go-unixfs.
+const depthRepeat = 4
+
+// Layout builds the DAG of the data of db with the named layout.
+func Layout(db helpers.Helper, layout string) (ipld.Node, error) {
+	switch layout {
+	case BalancedLayout, "":
+		return balanced.Layout(db)
+	case TrickleLayout:
+		return trickleLayout(db)
+	default:
+		return nil, fmt.Errorf("unknown DAG layout %q", layout)
+	}
+}
+
+// trickleLayout is the trickle.Layout of go-unixfs, which only accepts its own DagBuilderHelper, on top of the
+// Helper interface so the nodes go through the WrapDagBuilder.
+func trickleLayout(db helpers.Helper) (ipld.Node, error) {
+	newRoot := db.NewFSNodeOverDag(ft.TFile)
+	root, _, err := fillTrickleRec(db, newRoot, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	return root, db.Add(root)
+}
+
+// fillTrickleRec creates a trickle (sub-)tree with a maximum depth of maxDepth, or unlimited if it is -1.
+func fillTrickleRec(db helpers.Helper, node *helpers.FSNodeOverDag, maxDepth int) (ipld.Node, uint64, error) {
+	// Always do this, even in the base case
+	if err := db.FillNodeLayer(node); err != nil {
+		return nil, 0, err
+	}
+
+	// For each depth in [1, maxDepth) add depthRepeat sub-graphs of that depth.
+	for depth := 1; maxDepth == -1 || depth < maxDepth; depth++ {
+		if db.Done() {
+			break
+		}
+
+		for repeatIndex := 0; repeatIndex < depthRepeat && !db.Done(); repeatIndex++ {
+			childNode, childFileSize, err := fillTrickleRec(db, db.NewFSNodeOverDag(ft.TFile), depth)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			if err := node.AddChild(childNode, childFileSize, db); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	filledNode, err := node.Commit()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return filledNode, node.FileSize(), nil
+}
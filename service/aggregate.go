@@ -0,0 +1,511 @@
+package metaservice
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/dataswap/go-metadata/utils"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/ipfs/go-cid"
+	mt "github.com/txaty/go-merkletree"
+	"golang.org/x/xerrors"
+)
+
+const (
+	CACHE_AGGREGATE_PROOF_PATH = "aggregate.proof"
+
+	// SEGMENT_DESC_SIZE is the size of an entry of the data segment index, two nodes.
+	SEGMENT_DESC_SIZE = 2 * NODE_SIZE
+	// SEGMENT_CHECKSUM_SIZE is the size of the checksum of an entry of the data segment index.
+	SEGMENT_CHECKSUM_SIZE = 16
+)
+
+// SegmentDesc is an entry of the data segment index of an aggregate piece, see FRC-0058.
+// The offset and the size are in padded bytes.
+type SegmentDesc struct {
+	CommDs   []byte
+	Offset   uint64
+	Size     uint64
+	Checksum [SEGMENT_CHECKSUM_SIZE]byte
+}
+
+// InclusionProof proves a segment is included in an aggregate piece: ProofSubtree proves the commP of the segment
+// is the subtree at its offset, ProofIndex proves the node of its entry is in the data segment index.
+type InclusionProof struct {
+	ProofSubtree mt.Proof
+	ProofIndex   mt.Proof
+}
+
+// Aggregate is a piece aggregating segments, laid out in their order, each aligned to its size, with the data
+// segment index at the end of the piece.
+type Aggregate struct {
+	DealSize uint64
+	Segments []SegmentDesc
+	CommP    []byte
+
+	// nodes of the tree computed so far, the tree of a deal is too large to be built.
+	nodes map[aggregateNode][]byte
+}
+
+// aggregateNode is the position of a node in the tree of an aggregate, level 0 being the leaves.
+type aggregateNode struct {
+	level int
+	index uint64
+}
+
+// AggregateProof represents the aggregate piece of the cars and the inclusion proofs of its segments.
+type AggregateProof struct {
+	Root     string
+	PieceCid string
+	Size     uint64
+	Segments []SegmentProof
+}
+
+// SegmentProof represents a segment of the aggregate piece and its inclusion proof.
+type SegmentProof struct {
+	CommP           string
+	Offset          uint64
+	Size            uint64
+	SubtreeSiblings []string
+	SubtreePath     string
+	IndexSiblings   []string
+	IndexPath       string
+}
+
+// NewSegmentDesc creates the entry of the segment of commP at offset in the data segment index.
+func NewSegmentDesc(commP []byte, offset, size uint64) (*SegmentDesc, error) {
+	if len(commP) != NODE_SIZE {
+		return nil, xerrors.Errorf("provided commP must be exactly %d bytes long, got %d bytes instead", NODE_SIZE, len(commP))
+	}
+	sd := &SegmentDesc{
+		CommDs: commP,
+		Offset: offset,
+		Size:   size,
+	}
+	sd.Checksum = sd.checksum()
+	return sd, nil
+}
+
+// Serialize returns the two nodes of the entry: the commP, the offset and the size in little endian, and the checksum.
+func (sd *SegmentDesc) Serialize() []byte {
+	buf := make([]byte, SEGMENT_DESC_SIZE)
+	copy(buf[:NODE_SIZE], sd.CommDs)
+	binary.LittleEndian.PutUint64(buf[NODE_SIZE:], sd.Offset)
+	binary.LittleEndian.PutUint64(buf[NODE_SIZE+8:], sd.Size)
+	copy(buf[SEGMENT_DESC_SIZE-SEGMENT_CHECKSUM_SIZE:], sd.Checksum[:])
+	return buf
+}
+
+// Node returns the node of the entry in the tree of the aggregate, the parent of its two nodes.
+func (sd *SegmentDesc) Node() ([]byte, error) {
+	return NewHashFunc(sd.Serialize())
+}
+
+// Validate checks the checksum of the entry.
+func (sd *SegmentDesc) Validate() error {
+	if sd.checksum() != sd.Checksum {
+		return xerrors.Errorf("checksum of the segment at %d does not match", sd.Offset)
+	}
+	return nil
+}
+
+// checksum is the truncated sha256 of the entry with a zero checksum, the last byte is masked as the nodes are.
+func (sd *SegmentDesc) checksum() [SEGMENT_CHECKSUM_SIZE]byte {
+	cpy := *sd
+	cpy.Checksum = [SEGMENT_CHECKSUM_SIZE]byte{}
+	digest := sha256.Sum256(cpy.Serialize())
+	var checksum [SEGMENT_CHECKSUM_SIZE]byte
+	copy(checksum[:], digest[:SEGMENT_CHECKSUM_SIZE])
+	checksum[SEGMENT_CHECKSUM_SIZE-1] &= 0x3F
+	return checksum
+}
+
+// MaxIndexEntries returns the number of entries of the data segment index of a deal of dealSize padded bytes.
+func MaxIndexEntries(dealSize uint64) uint64 {
+	entries := dealSize / 2048 / SEGMENT_DESC_SIZE
+	if entries <= 4 {
+		return 4
+	}
+	return 1 << bits.Len64(entries-1)
+}
+
+// IndexStart returns the padded offset of the data segment index of a deal of dealSize padded bytes.
+func IndexStart(dealSize uint64) uint64 {
+	return dealSize - MaxIndexEntries(dealSize)*SEGMENT_DESC_SIZE
+}
+
+// NewAggregate lays out the segments of commPs of padded sizes in a deal of dealSize padded bytes and computes its
+// commP. dealSize = 0 is use the smallest deal the segments fit in.
+func NewAggregate(dealSize uint64, commPs [][]byte, sizes []uint64) (*Aggregate, error) {
+	if len(commPs) != len(sizes) {
+		return nil, xerrors.Errorf("got %d commPs of %d sizes", len(commPs), len(sizes))
+	}
+	if len(commPs) == 0 {
+		return nil, xerrors.Errorf("the number of segments must be greater than 0")
+	}
+	for _, size := range sizes {
+		if bits.OnesCount64(size) != 1 || size < SLAB_CHUNK_SIZE {
+			return nil, xerrors.Errorf("segment padded size %d is not a power of 2 of at least %d bytes", size, SLAB_CHUNK_SIZE)
+		}
+	}
+
+	var offsets []uint64
+	var err error
+	if dealSize == 0 {
+		var total uint64
+		for _, size := range sizes {
+			total += size
+		}
+		// the smallest deal which the segments fit in with the index.
+		for dealSize = 1 << bits.Len64(total-1); dealSize <= MaxPieceSize; dealSize <<= 1 {
+			if offsets, err = layoutSegments(dealSize, sizes); err == nil {
+				break
+			}
+		}
+		if offsets == nil {
+			return nil, xerrors.Errorf("segments of %d bytes do not fit in the maximum piece size %d", total, MaxPieceSize)
+		}
+	} else {
+		if bits.OnesCount64(dealSize) != 1 || dealSize > MaxPieceSize {
+			return nil, xerrors.Errorf("deal padded size %d is not a power of 2 up to %d", dealSize, MaxPieceSize)
+		}
+		if offsets, err = layoutSegments(dealSize, sizes); err != nil {
+			return nil, err
+		}
+	}
+
+	a := &Aggregate{
+		DealSize: dealSize,
+		Segments: make([]SegmentDesc, len(commPs)),
+		nodes:    make(map[aggregateNode][]byte),
+	}
+	for i, commP := range commPs {
+		sd, err := NewSegmentDesc(commP, offsets[i], sizes[i])
+		if err != nil {
+			return nil, err
+		}
+		a.Segments[i] = *sd
+	}
+
+	if a.CommP, err = a.node(a.depth(), 0); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// PieceCid returns the commP of the aggregate as a piece CID.
+func (a *Aggregate) PieceCid() (cid.Cid, error) {
+	return commcid.DataCommitmentV1ToCID(a.CommP)
+}
+
+// InclusionProof generates the inclusion proof of the i-th segment.
+func (a *Aggregate) InclusionProof(i int) (*InclusionProof, error) {
+	if i < 0 || i >= len(a.Segments) {
+		return nil, xerrors.Errorf("segment %d is out of the range %d", i, len(a.Segments))
+	}
+	sd := a.Segments[i]
+	level := bits.TrailingZeros64(sd.Size / NODE_SIZE)
+	subtree, err := a.proof(level, sd.Offset/sd.Size)
+	if err != nil {
+		return nil, err
+	}
+	index, err := a.proof(1, IndexStart(a.DealSize)/SEGMENT_DESC_SIZE+uint64(i))
+	if err != nil {
+		return nil, err
+	}
+	return &InclusionProof{ProofSubtree: *subtree, ProofIndex: *index}, nil
+}
+
+// VerifyInclusionProof verifies the segment of commP of a padded size is included in the aggregate of
+// aggregateCommP of dealSize padded bytes, the offset of the segment is the one proven by ProofSubtree.
+func VerifyInclusionProof(commP []byte, size uint64, proof *InclusionProof, aggregateCommP []byte, dealSize uint64) (bool, error) {
+	if proof == nil {
+		return false, xerrors.Errorf("inclusion proof is nil")
+	}
+	if bits.OnesCount64(size) != 1 || size < SLAB_CHUNK_SIZE {
+		return false, xerrors.Errorf("segment padded size %d is not a power of 2 of at least %d bytes", size, SLAB_CHUNK_SIZE)
+	}
+	if bits.OnesCount64(dealSize) != 1 || dealSize > MaxPieceSize {
+		return false, xerrors.Errorf("deal padded size %d is not a power of 2 up to %d", dealSize, MaxPieceSize)
+	}
+	if dealSize <= MaxIndexEntries(dealSize)*SEGMENT_DESC_SIZE {
+		return false, xerrors.Errorf("a deal of %d bytes is too small for the index", dealSize)
+	}
+
+	// the depths of the proofs tell the size of the deal.
+	if len(proof.ProofSubtree.Siblings) > int(MaxLayers) || len(proof.ProofIndex.Siblings) > int(MaxLayers) {
+		return false, nil
+	}
+	if size<<len(proof.ProofSubtree.Siblings) != dealSize || SEGMENT_DESC_SIZE<<len(proof.ProofIndex.Siblings) != dealSize {
+		return false, nil
+	}
+
+	offset := proofIndex(&proof.ProofSubtree) * size
+	if offset+size > IndexStart(dealSize) {
+		return false, nil
+	}
+	if proofIndex(&proof.ProofIndex) < IndexStart(dealSize)/SEGMENT_DESC_SIZE {
+		return false, nil
+	}
+
+	rst, err := mt.Verify(&DataBlock{Data: commP}, &proof.ProofSubtree, aggregateCommP, CommpHashConfig)
+	if err != nil || !rst {
+		return false, err
+	}
+
+	sd, err := NewSegmentDesc(commP, offset, size)
+	if err != nil {
+		return false, err
+	}
+	node, err := sd.Node()
+	if err != nil {
+		return false, err
+	}
+	return mt.Verify(&DataBlock{Data: node}, &proof.ProofIndex, aggregateCommP, CommpHashConfig)
+}
+
+// GenAggregateProof aggregates the cars of rawCommP.cache in a deal of dealSize padded bytes, the largest first,
+// and stores the aggregate and the inclusion proofs of the cars. dealSize = 0 is use the smallest deal.
+func GenAggregateProof(cachePath string, dealSize uint64) (*Aggregate, error) {
+	commPs, carSizes := LoadSortCommp(cachePath)
+	if commPs == nil {
+		return nil, xerrors.Errorf("commPs is nil")
+	}
+
+	// the largest segments first leave no gap to align the next ones.
+	order := make([]int, len(commPs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return carSizes[order[i]] > carSizes[order[j]]
+	})
+	segments := make([][]byte, len(order))
+	sizes := make([]uint64, len(order))
+	for i, o := range order {
+		segments[i] = commPs[o]
+		sizes[i] = PaddedPieceSize(carSizes[o])
+	}
+
+	a, err := NewAggregate(dealSize, segments, sizes)
+	if err != nil {
+		return nil, err
+	}
+
+	pieceCid, err := a.PieceCid()
+	if err != nil {
+		return nil, err
+	}
+	aggregateProof := AggregateProof{
+		Root:     utils.ConvertToHexPrefix(a.CommP),
+		PieceCid: pieceCid.String(),
+		Size:     a.DealSize,
+		Segments: make([]SegmentProof, len(a.Segments)),
+	}
+	for i, sd := range a.Segments {
+		proof, err := a.InclusionProof(i)
+		if err != nil {
+			return nil, err
+		}
+		aggregateProof.Segments[i] = SegmentProof{
+			CommP:  utils.ConvertToHexPrefix(sd.CommDs),
+			Offset: sd.Offset,
+			Size:   sd.Size,
+		}
+		aggregateProof.Segments[i].SubtreeSiblings, aggregateProof.Segments[i].SubtreePath = hexProof(proof.ProofSubtree)
+		aggregateProof.Segments[i].IndexSiblings, aggregateProof.Segments[i].IndexPath = hexProof(proof.ProofIndex)
+	}
+
+	if err := utils.WriteJson(createPath(cachePath, CACHE_AGGREGATE_PROOF_PATH), "\t", aggregateProof); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// VerifyAggregateProof verifies the inclusion proofs of the aggregate stored by GenAggregateProof, every car of
+// rawCommP.cache must be included at the offset of its segment.
+func VerifyAggregateProof(cachePath string) (bool, error) {
+	var aggregateProof AggregateProof
+	if err := utils.ReadJson(createPath(cachePath, CACHE_AGGREGATE_PROOF_PATH), &aggregateProof); err != nil {
+		return false, err
+	}
+	root, err := utils.ParseHexWithPrefix(aggregateProof.Root)
+	if err != nil {
+		return false, err
+	}
+
+	commPs, carSizes := LoadSortCommp(cachePath)
+	if commPs == nil {
+		return false, xerrors.Errorf("commPs is nil")
+	}
+	if len(commPs) != len(aggregateProof.Segments) {
+		return false, nil
+	}
+	cars := make(map[string]uint64, len(commPs))
+	for i, commP := range commPs {
+		cars[string(commP)] = PaddedPieceSize(carSizes[i])
+	}
+
+	for _, segment := range aggregateProof.Segments {
+		commP, err := utils.ParseHexWithPrefix(segment.CommP)
+		if err != nil {
+			return false, err
+		}
+		if size, ok := cars[string(commP)]; !ok || size != segment.Size {
+			return false, nil
+		}
+		delete(cars, string(commP))
+
+		var proof InclusionProof
+		if proof.ProofSubtree, err = parseHexProof(segment.SubtreeSiblings, segment.SubtreePath); err != nil {
+			return false, err
+		}
+		if proof.ProofIndex, err = parseHexProof(segment.IndexSiblings, segment.IndexPath); err != nil {
+			return false, err
+		}
+		if proofIndex(&proof.ProofSubtree)*segment.Size != segment.Offset {
+			return false, nil
+		}
+		rst, err := VerifyInclusionProof(commP, segment.Size, &proof, root, aggregateProof.Size)
+		if err != nil || !rst {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+//### internal functions
+
+// layoutSegments returns the padded offsets of the segments of sizes, each aligned to its size after the previous
+// one, in a deal of dealSize padded bytes.
+func layoutSegments(dealSize uint64, sizes []uint64) ([]uint64, error) {
+	if dealSize <= MaxIndexEntries(dealSize)*SEGMENT_DESC_SIZE {
+		return nil, xerrors.Errorf("a deal of %d bytes is too small for the index", dealSize)
+	}
+	if uint64(len(sizes)) > MaxIndexEntries(dealSize) {
+		return nil, xerrors.Errorf("%d segments exceed the %d entries of the index of a deal of %d bytes", len(sizes), MaxIndexEntries(dealSize), dealSize)
+	}
+	offsets := make([]uint64, len(sizes))
+	var end uint64
+	for i, size := range sizes {
+		offsets[i] = (end + size - 1) / size * size
+		end = offsets[i] + size
+		if end > IndexStart(dealSize) {
+			return nil, xerrors.Errorf("segment %d of %d bytes overlaps the index of a deal of %d bytes", i, size, dealSize)
+		}
+	}
+	return offsets, nil
+}
+
+// depth returns the number of levels above the leaves of the tree of the aggregate.
+func (a *Aggregate) depth() int {
+	return bits.TrailingZeros64(a.DealSize / NODE_SIZE)
+}
+
+// node returns the node of the tree of the aggregate at level and index: the commP of a segment, the node of an
+// entry of the index, the nul padding of an empty subtree or the hash of its children.
+func (a *Aggregate) node(level int, index uint64) ([]byte, error) {
+	key := aggregateNode{level: level, index: index}
+	if n, ok := a.nodes[key]; ok {
+		return n, nil
+	}
+
+	start := (index << level) * NODE_SIZE
+	end := start + NODE_SIZE<<level
+
+	// the first segment ending after the start of the subtree, the segments are sorted by offset.
+	i := sort.Search(len(a.Segments), func(i int) bool {
+		return a.Segments[i].Offset+a.Segments[i].Size > start
+	})
+	if i < len(a.Segments) && a.Segments[i].Offset == start && a.Segments[i].Size == end-start {
+		return a.Segments[i].CommDs, nil
+	}
+	overlaps := i < len(a.Segments) && a.Segments[i].Offset < end
+
+	indexStart := IndexStart(a.DealSize)
+	indexEnd := indexStart + uint64(len(a.Segments))*SEGMENT_DESC_SIZE
+	if level == 1 && start >= indexStart && start < indexEnd {
+		return a.Segments[(start-indexStart)/SEGMENT_DESC_SIZE].Node()
+	}
+	if !overlaps && (end <= indexStart || start >= indexEnd) {
+		return StackedNulPadding[level], nil
+	}
+
+	left, err := a.node(level-1, index<<1)
+	if err != nil {
+		return nil, err
+	}
+	right, err := a.node(level-1, index<<1|1)
+	if err != nil {
+		return nil, err
+	}
+	n, err := NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), left...), right...))
+	if err != nil {
+		return nil, err
+	}
+	a.nodes[key] = n
+	return n, nil
+}
+
+// proof generates the proof of the node at level and index up to the root of the aggregate.
+func (a *Aggregate) proof(level int, index uint64) (*mt.Proof, error) {
+	proof := &mt.Proof{}
+	for i := 0; level+i < a.depth(); i++ {
+		sibling, err := a.node(level+i, index^1)
+		if err != nil {
+			return nil, err
+		}
+		if index&1 == 0 {
+			proof.Path |= 1 << i
+		}
+		proof.Siblings = append(proof.Siblings, sibling)
+		index >>= 1
+	}
+	return proof, nil
+}
+
+// proofIndex returns the index of the node proven by proof at its level, the path tells whether it is on the left.
+func proofIndex(proof *mt.Proof) uint64 {
+	var index uint64
+	for i := range proof.Siblings {
+		if proof.Path&(1<<i) == 0 {
+			index |= 1 << i
+		}
+	}
+	return index
+}
+
+// hexProof returns the siblings and the path of proof in the hex format of the proof files.
+func hexProof(proof mt.Proof) ([]string, string) {
+	siblings := make([]string, len(proof.Siblings))
+	for i, sibling := range proof.Siblings {
+		siblings[i] = utils.ConvertToHexPrefix(sibling)
+	}
+	return siblings, fmt.Sprintf("0x%x", proof.Path)
+}
+
+// parseHexProof parses the siblings and the path of a proof in the hex format of the proof files.
+func parseHexProof(siblings []string, path string) (mt.Proof, error) {
+	proof := mt.Proof{Siblings: make([][]byte, len(siblings))}
+	for i, sibling := range siblings {
+		s, err := utils.ParseHexWithPrefix(sibling)
+		if err != nil {
+			return mt.Proof{}, err
+		}
+		if len(s) != NODE_SIZE {
+			return mt.Proof{}, xerrors.Errorf("sibling %s is not a node", sibling)
+		}
+		proof.Siblings[i] = s
+	}
+	p, err := strconv.ParseUint(path, 0, 32)
+	if err != nil {
+		return mt.Proof{}, err
+	}
+	proof.Path = uint32(p)
+	return proof, nil
+}
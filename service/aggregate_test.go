@@ -0,0 +1,148 @@
+package metaservice
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/dataswap/go-metadata/utils"
+	mt "github.com/txaty/go-merkletree"
+	"gotest.tools/assert"
+)
+
+// newTestSegments returns the commPs, the padded sizes and the padded leaves of random data of the source sizes.
+func newTestSegments(t *testing.T, sourceSizes []int) ([][]byte, []uint64, [][]mt.DataBlock) {
+	rnd := rand.New(rand.NewSource(1))
+	calc := NewCommPCalculator()
+	var commPs [][]byte
+	var sizes []uint64
+	var leaves [][]mt.DataBlock
+	for _, sourceSize := range sourceSizes {
+		data := make([]byte, sourceSize)
+		rnd.Read(data)
+		commP, size, err := calc.Sum(bytes.NewReader(data))
+		assert.NilError(t, err)
+		blocks, _, err := calc.PaddedDataBlocks(*bytes.NewBuffer(data), 0)
+		assert.NilError(t, err)
+		commPs = append(commPs, commP)
+		sizes = append(sizes, size)
+		leaves = append(leaves, blocks)
+	}
+	return commPs, sizes, leaves
+}
+
+// denseAggregateRoot builds the whole tree of the aggregate from the leaves of its segments and of its index.
+func denseAggregateRoot(t *testing.T, a *Aggregate, leaves [][]mt.DataBlock) []byte {
+	blocks := make([]mt.DataBlock, a.DealSize/NODE_SIZE)
+	for i := range blocks {
+		blocks[i] = &DataBlock{Data: make([]byte, NODE_SIZE)}
+	}
+	for i, sd := range a.Segments {
+		copy(blocks[sd.Offset/NODE_SIZE:], leaves[i])
+		entry := sd.Serialize()
+		at := IndexStart(a.DealSize)/NODE_SIZE + uint64(2*i)
+		blocks[at] = &DataBlock{Data: entry[:NODE_SIZE]}
+		blocks[at+1] = &DataBlock{Data: entry[NODE_SIZE:]}
+	}
+	tree, err := mt.NewWithPadding(CommpHashConfig, blocks, StackedNulPadding)
+	assert.NilError(t, err)
+	return tree.Root
+}
+
+func TestAggregate(t *testing.T) {
+	commPs, sizes, leaves := newTestSegments(t, []int{127 * 16, 127, 127 * 3, 100})
+	assert.DeepEqual(t, sizes, []uint64{2048, 128, 512, 128})
+
+	for _, dealSize := range []uint64{0, 4096, 8192, 1 << 20} {
+		a, err := NewAggregate(dealSize, commPs, sizes)
+		assert.NilError(t, err)
+		if dealSize == 0 {
+			// the smallest deal the segments fit in with the index.
+			assert.Equal(t, a.DealSize, uint64(4096))
+		}
+		assert.DeepEqual(t, a.CommP, denseAggregateRoot(t, a, leaves))
+
+		// the segments are aligned to their size in their order.
+		offsets := []uint64{0, 2048, 2560, 3072}
+		for i, sd := range a.Segments {
+			assert.Equal(t, sd.Offset, offsets[i])
+			assert.NilError(t, sd.Validate())
+
+			proof, err := a.InclusionProof(i)
+			assert.NilError(t, err)
+			rst, err := VerifyInclusionProof(sd.CommDs, sd.Size, proof, a.CommP, a.DealSize)
+			assert.NilError(t, err)
+			assert.Assert(t, rst, "segment %d of deal %d", i, a.DealSize)
+
+			// another segment, size, offset, root or deal size does not verify.
+			other := commPs[(i+1)%len(commPs)]
+			rst, _ = VerifyInclusionProof(other, sd.Size, proof, a.CommP, a.DealSize)
+			assert.Assert(t, !rst)
+			rst, _ = VerifyInclusionProof(sd.CommDs, sd.Size*2, proof, a.CommP, a.DealSize)
+			assert.Assert(t, !rst)
+			rst, _ = VerifyInclusionProof(sd.CommDs, sd.Size, proof, other, a.DealSize)
+			assert.Assert(t, !rst)
+			rst, _ = VerifyInclusionProof(sd.CommDs, sd.Size, proof, a.CommP, a.DealSize*2)
+			assert.Assert(t, !rst)
+			moved := *proof
+			moved.ProofSubtree.Path ^= 1
+			rst, _ = VerifyInclusionProof(sd.CommDs, sd.Size, &moved, a.CommP, a.DealSize)
+			assert.Assert(t, !rst)
+		}
+	}
+
+	_, err := NewAggregate(2048, commPs, sizes)
+	assert.ErrorContains(t, err, "overlaps the index")
+	_, err = NewAggregate(256, commPs[1:2], sizes[1:2])
+	assert.ErrorContains(t, err, "too small for the index")
+	_, err = NewAggregate(8192, append(commPs, commPs[0]), append(sizes, sizes[0]))
+	assert.ErrorContains(t, err, "exceed the 4 entries")
+	_, err = NewAggregate(8192, commPs[:1], []uint64{384})
+	assert.ErrorContains(t, err, "not a power of 2")
+}
+
+func TestMaxIndexEntries(t *testing.T) {
+	for dealSize, entries := range map[uint64]uint64{
+		256:            4,
+		1 << 20:        8,
+		1 << 29:        4096,
+		CAR_32GIB_SIZE: 1 << 18,
+		MaxPieceSize:   1 << 19,
+	} {
+		assert.Equal(t, MaxIndexEntries(dealSize), entries, "deal of %d bytes", dealSize)
+	}
+}
+
+func TestAggregateProof(t *testing.T) {
+	cachePath := t.TempDir()
+	commPs, _, _ := newTestSegments(t, []int{1000, 100000, 5000})
+	for i, carSize := range []uint64{1000, 100000, 5000} {
+		assert.NilError(t, SaveCommP(commPs[i], carSize, cachePath))
+	}
+
+	a, err := GenAggregateProof(cachePath, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, a.DealSize, uint64(1<<18))
+	// the largest car first.
+	assert.DeepEqual(t, a.Segments[0].CommDs, commPs[1])
+	rst, err := VerifyAggregateProof(cachePath)
+	assert.NilError(t, err)
+	assert.Assert(t, rst)
+
+	// a segment at another offset does not verify.
+	cPath := createPath(cachePath, CACHE_AGGREGATE_PROOF_PATH)
+	var aggregateProof AggregateProof
+	assert.NilError(t, utils.ReadJson(cPath, &aggregateProof))
+	aggregateProof.Segments[2].Offset += aggregateProof.Segments[2].Size
+	assert.NilError(t, utils.WriteJson(cPath, "\t", aggregateProof))
+	rst, _ = VerifyAggregateProof(cachePath)
+	assert.Assert(t, !rst)
+
+	// a car missing from the aggregate does not verify.
+	_, err = GenAggregateProof(cachePath, 0)
+	assert.NilError(t, err)
+	extra, _, _ := newTestSegments(t, []int{300})
+	assert.NilError(t, SaveCommP(extra[0], 300, cachePath))
+	rst, _ = VerifyAggregateProof(cachePath)
+	assert.Assert(t, !rst)
+}
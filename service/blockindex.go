@@ -0,0 +1,306 @@
+package metaservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ipfs/bbloom"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// bits of the filter of the CIDs of the spilled block offsets, its false positives only cost a lookup on the disk
+	BLOCK_INDEX_FILTER_BITS = 1 << 27
+	// number of records of a run between two keys of its sparse index kept in memory
+	BLOCK_INDEX_PAGE_SIZE = 256
+	// number of runs above which the runs are merged into one
+	BLOCK_INDEX_MAX_RUNS = 8
+)
+
+// blockIndex maps the CIDs of the blocks of a car to their offsets. Once it holds limit offsets in memory they are
+// spilled to the disk in a run sorted by CID, so the memory does not grow with the number of blocks. The CIDs of the
+// spilled offsets are added to a filter of a bounded size, a CID it does not have is not looked up on the disk,
+// which is the case of the blocks written for the first time. Runs are merged once there are too many of them.
+// The caller synchronizes the accesses.
+type blockIndex struct {
+	parent string // directory the spill directory is created in, no spill when empty
+	limit  int    // number of offsets spilled at once
+
+	recent map[cid.Cid]uint64
+	filter *bbloom.Bloom
+	dir    string
+	runs   []*indexRun
+}
+
+// indexRun is a run of offsets spilled to the disk, a sequence of records of the length prefixed CID and its offset.
+type indexRun struct {
+	path string
+	f    *os.File
+	size int64
+	keys [][]byte // CID of the first record of every page
+	pos  []int64  // position of every page in the file
+}
+
+func newBlockIndex() *blockIndex {
+	return &blockIndex{recent: make(map[cid.Cid]uint64)}
+}
+
+// spill spills the offsets to a directory created under path once limit of them are in memory.
+func (bi *blockIndex) spill(path string, limit int) {
+	bi.parent = path
+	bi.limit = limit
+}
+
+// get returns the offset of the block.
+func (bi *blockIndex) get(c cid.Cid) (uint64, bool, error) {
+	if offset, ok := bi.recent[c]; ok {
+		return offset, true, nil
+	}
+	if bi.filter == nil || !bi.filter.Has(c.Bytes()) {
+		return 0, false, nil
+	}
+	for i := len(bi.runs) - 1; i >= 0; i-- {
+		offset, ok, err := bi.runs[i].get(c.Bytes())
+		if err != nil || ok {
+			return offset, ok, err
+		}
+	}
+	return 0, false, nil
+}
+
+// put adds the offset of a block not in the index.
+func (bi *blockIndex) put(c cid.Cid, offset uint64) error {
+	bi.recent[c] = offset
+	if bi.parent == "" || bi.limit <= 0 || len(bi.recent) < bi.limit {
+		return nil
+	}
+	return bi.writeRun()
+}
+
+// writeRun spills the offsets in memory to a new run.
+func (bi *blockIndex) writeRun() error {
+	if bi.dir == "" {
+		if err := os.MkdirAll(bi.parent, 0o775); err != nil {
+			return err
+		}
+		dir, err := os.MkdirTemp(bi.parent, ".index-")
+		if err != nil {
+			return err
+		}
+		filter, err := bbloom.New(float64(BLOCK_INDEX_FILTER_BITS), 7)
+		if err != nil {
+			return err
+		}
+		bi.dir = dir
+		bi.filter = filter
+	}
+
+	keys := make([][]byte, 0, len(bi.recent))
+	offsets := make(map[string]uint64, len(bi.recent))
+	for c, offset := range bi.recent {
+		key := c.Bytes()
+		keys = append(keys, key)
+		offsets[string(key)] = offset
+		bi.filter.Add(key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	i := 0
+	run, err := bi.createRun(func() ([]byte, uint64, error) {
+		if i == len(keys) {
+			return nil, 0, io.EOF
+		}
+		key := keys[i]
+		i++
+		return key, offsets[string(key)], nil
+	})
+	if err != nil {
+		return err
+	}
+	bi.runs = append(bi.runs, run)
+	bi.recent = make(map[cid.Cid]uint64)
+
+	if len(bi.runs) > BLOCK_INDEX_MAX_RUNS {
+		return bi.mergeRuns()
+	}
+	return nil
+}
+
+// mergeRuns merges the runs into a single one.
+func (bi *blockIndex) mergeRuns() error {
+	type head struct {
+		r      *bufio.Reader
+		key    []byte
+		offset uint64
+	}
+	heads := make([]*head, 0, len(bi.runs))
+	for _, run := range bi.runs {
+		h := &head{r: bufio.NewReader(io.NewSectionReader(run.f, 0, run.size))}
+		key, offset, err := readIndexRecord(h.r)
+		if err != nil {
+			return fmt.Errorf("spilled block offsets %s: %w", run.path, err)
+		}
+		h.key, h.offset = key, offset
+		heads = append(heads, h)
+	}
+
+	// the runs are few, the smallest key of their heads is looked for linearly.
+	merged, err := bi.createRun(func() ([]byte, uint64, error) {
+		var min *head
+		var at int
+		for i, h := range heads {
+			if min == nil || bytes.Compare(h.key, min.key) < 0 {
+				min, at = h, i
+			}
+		}
+		if min == nil {
+			return nil, 0, io.EOF
+		}
+		key, offset := min.key, min.offset
+		next, nextOffset, err := readIndexRecord(min.r)
+		if err == io.EOF {
+			heads = append(heads[:at], heads[at+1:]...)
+		} else if err != nil {
+			return nil, 0, err
+		} else {
+			min.key, min.offset = next, nextOffset
+		}
+		return key, offset, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, run := range bi.runs {
+		run.f.Close()
+		os.Remove(run.path)
+	}
+	bi.runs = []*indexRun{merged}
+	return nil
+}
+
+// createRun writes the records returned by next in order to a new run, until it returns io.EOF.
+func (bi *blockIndex) createRun(next func() ([]byte, uint64, error)) (*indexRun, error) {
+	f, err := os.CreateTemp(bi.dir, "run")
+	if err != nil {
+		return nil, err
+	}
+	run := &indexRun{path: f.Name(), f: f}
+	w := bufio.NewWriter(f)
+	var record []byte
+	for n := 0; ; n++ {
+		key, offset, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if n%BLOCK_INDEX_PAGE_SIZE == 0 {
+			run.keys = append(run.keys, key)
+			run.pos = append(run.pos, run.size)
+		}
+		record = binary.AppendUvarint(record[:0], uint64(len(key)))
+		record = append(record, key...)
+		record = binary.AppendUvarint(record, offset)
+		if _, err := w.Write(record); err != nil {
+			f.Close()
+			return nil, err
+		}
+		run.size += int64(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return run, nil
+}
+
+// get looks the key up in the page of the run it would be in.
+func (r *indexRun) get(key []byte) (uint64, bool, error) {
+	i := sort.Search(len(r.keys), func(i int) bool {
+		return bytes.Compare(r.keys[i], key) > 0
+	}) - 1
+	if i < 0 {
+		return 0, false, nil
+	}
+	end := r.size
+	if i+1 < len(r.pos) {
+		end = r.pos[i+1]
+	}
+	br := bufio.NewReader(io.NewSectionReader(r.f, r.pos[i], end-r.pos[i]))
+	for {
+		k, offset, err := readIndexRecord(br)
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("spilled block offsets %s: %w", r.path, err)
+		}
+		if c := bytes.Compare(k, key); c >= 0 {
+			return offset, c == 0, nil
+		}
+	}
+}
+
+// keys calls fn with the CIDs of the index.
+func (bi *blockIndex) keys(fn func(c cid.Cid) error) error {
+	for c := range bi.recent {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	for _, run := range bi.runs {
+		br := bufio.NewReader(io.NewSectionReader(run.f, 0, run.size))
+		for {
+			key, _, err := readIndexRecord(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("spilled block offsets %s: %w", run.path, err)
+			}
+			c, err := cid.Cast(key)
+			if err != nil {
+				return err
+			}
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// remove deletes the runs.
+func (bi *blockIndex) remove() error {
+	for _, run := range bi.runs {
+		run.f.Close()
+	}
+	bi.runs = nil
+	if bi.dir == "" {
+		return nil
+	}
+	dir := bi.dir
+	bi.dir = ""
+	return os.RemoveAll(dir)
+}
+
+// readIndexRecord reads the next record of a run, io.EOF at its end.
+func readIndexRecord(r *bufio.Reader) ([]byte, uint64, error) {
+	key, err := readBytes(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return key, offset, err
+}
@@ -0,0 +1,56 @@
+package metaservice
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"gotest.tools/assert"
+)
+
+func TestBlockIndex(t *testing.T) {
+	prefix := merkledag.V1CidPrefix()
+	newCid := func(i int) cid.Cid {
+		c, err := prefix.Sum([]byte(fmt.Sprint(i)))
+		assert.NilError(t, err)
+		return c
+	}
+
+	path := filepath.Join(t.TempDir(), "index")
+	bi := newBlockIndex()
+	bi.spill(path, 100)
+	const n = 5000
+	for i := 0; i < n; i++ {
+		assert.NilError(t, bi.put(newCid(i), uint64(i)*7))
+		assert.Assert(t, len(bi.recent) < 100)
+		assert.Assert(t, len(bi.runs) <= BLOCK_INDEX_MAX_RUNS)
+	}
+
+	// the offsets are found in memory, in the runs spilled and in the runs merged, over several pages.
+	for i := 0; i < n; i++ {
+		offset, ok, err := bi.get(newCid(i))
+		assert.NilError(t, err)
+		assert.Assert(t, ok, "offset %d is not found", i)
+		assert.Equal(t, offset, uint64(i)*7)
+	}
+	for i := n; i < n+100; i++ {
+		_, ok, err := bi.get(newCid(i))
+		assert.NilError(t, err)
+		assert.Assert(t, !ok)
+	}
+
+	keys := make(map[cid.Cid]struct{})
+	assert.NilError(t, bi.keys(func(c cid.Cid) error {
+		keys[c] = struct{}{}
+		return nil
+	}))
+	assert.Equal(t, len(keys), n)
+
+	assert.NilError(t, bi.remove())
+	entries, err := os.ReadDir(path)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
@@ -0,0 +1,358 @@
+package metaservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/data-preservation-programs/singularity/pack"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-car/util"
+)
+
+// size of the write buffer of the CarWriter
+const CAR_WRITER_BUFFER_SIZE = 4 << 20
+
+// CarBlock is the boundary of a block written to a car.
+type CarBlock struct {
+	Cid    cid.Cid
+	Offset uint64 // start of the length prefix of the block
+	Size   uint64 // size of the block with its length prefix and CID
+}
+
+// CarWriter is a blockstore writing the blocks put into it to a CARv1 file as they come, so the DAG is built once
+// and the car is written along. Blocks are written once, in the order they are first put, which for the DAGs of the
+// unixfs importer is a post-order traversal from the root. The header is written with a placeholder root of the size
+// of the root CID and patched by Finish. Blocks are read back from the car file. The boundaries of the written blocks
+// are reported to the callback of OnBlock as they are written. The car is hashed into its commP writer as it is
+// written, so it is not read again to compute its commP. The offsets of the blocks are kept in memory, or spilled to
+// the disk along the mappings of a MappingService recording the blocks with the SpillMappings option.
+type CarWriter struct {
+	f          *os.File
+	w          *bufio.Writer
+	commp      *CommPWriter
+	headerSize uint64
+	size       uint64 // end of the written blocks
+	shift      int64  // how far Finish moved the blocks after they were reported
+
+	lk      sync.RWMutex
+	index   *blockIndex // offsets of the blocks after the header
+	onBlock func(block CarBlock)
+}
+
+var _ bstore.Blockstore = (*CarWriter)(nil)
+
+// NewCarWriter creates the car file at path for a DAG whose root has the CID prefix.
+func NewCarWriter(path string, prefix cid.Prefix) (*CarWriter, error) {
+	placeholder, err := prefix.Sum(nil)
+	if err != nil {
+		return nil, err
+	}
+	header, err := pack.GenerateCarHeader(placeholder)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	commp := NewCommPWriter()
+	w := bufio.NewWriterSize(io.MultiWriter(f, commp), CAR_WRITER_BUFFER_SIZE)
+	if _, err := w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &CarWriter{
+		f:          f,
+		w:          w,
+		commp:      commp,
+		headerSize: uint64(len(header)),
+		size:       uint64(len(header)),
+		index:      newBlockIndex(),
+	}, nil
+}
+
+// spillIndex spills the offsets of the blocks to a directory created under path once limit of them are in memory.
+func (cw *CarWriter) spillIndex(path string, limit int) {
+	cw.lk.Lock()
+	defer cw.lk.Unlock()
+	cw.index.spill(path, limit)
+}
+
+// removeIndex deletes the offsets of the blocks spilled to the disk, the blocks cannot be read back any more.
+func (cw *CarWriter) removeIndex() error {
+	cw.lk.Lock()
+	defer cw.lk.Unlock()
+	return cw.index.remove()
+}
+
+// Put writes the block unless it is already in the car.
+func (cw *CarWriter) Put(ctx context.Context, block blocks.Block) error {
+	cw.lk.Lock()
+	defer cw.lk.Unlock()
+	return cw.put(block)
+}
+
+// PutMany writes the blocks in order.
+func (cw *CarWriter) PutMany(ctx context.Context, blks []blocks.Block) error {
+	cw.lk.Lock()
+	defer cw.lk.Unlock()
+	for _, block := range blks {
+		if err := cw.put(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cw *CarWriter) put(block blocks.Block) error {
+	c := block.Cid()
+	if _, ok, err := cw.index.get(c); err != nil || ok {
+		return err
+	}
+	if err := util.LdWrite(cw.w, c.Bytes(), block.RawData()); err != nil {
+		return err
+	}
+	size := util.LdSize(c.Bytes(), block.RawData())
+	if err := cw.index.put(c, cw.size-cw.headerSize); err != nil {
+		return err
+	}
+	if cw.onBlock != nil {
+		cw.onBlock(CarBlock{Cid: c, Offset: cw.size, Size: size})
+	}
+	cw.size += size
+	return nil
+}
+
+// OnBlock sets the callback the boundary of every block is reported to when it is written, in the order of the car.
+func (cw *CarWriter) OnBlock(fn func(block CarBlock)) {
+	cw.lk.Lock()
+	defer cw.lk.Unlock()
+	cw.onBlock = fn
+}
+
+// Has returns whether the block is in the car.
+func (cw *CarWriter) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	cw.lk.RLock()
+	defer cw.lk.RUnlock()
+	_, ok, err := cw.index.get(c)
+	return ok, err
+}
+
+// Get reads the block back from the car.
+func (cw *CarWriter) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	data, err := cw.read(c)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// GetSize returns the size of the data of the block.
+func (cw *CarWriter) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	data, err := cw.read(c)
+	if err != nil {
+		return -1, err
+	}
+	return len(data), nil
+}
+
+// read returns the data of the block at its offset in the car. The write buffer is only flushed when the block is
+// still in it, so reading blocks back does not cut the writes of the car into small ones.
+func (cw *CarWriter) read(c cid.Cid) ([]byte, error) {
+	cw.lk.Lock()
+	defer cw.lk.Unlock()
+	offset, ok, err := cw.index.get(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	offset += cw.headerSize
+	flushed := cw.size - uint64(cw.w.Buffered())
+	if offset >= flushed {
+		if err := cw.w.Flush(); err != nil {
+			return nil, err
+		}
+		flushed = cw.size
+	}
+
+	block, err := cw.readBlock(offset, flushed)
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && flushed < cw.size {
+		// the end of the block is still in the buffer.
+		if err := cw.w.Flush(); err != nil {
+			return nil, err
+		}
+		block, err = cw.readBlock(offset, cw.size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := len(c.Bytes())
+	if n > len(block) || !bytes.Equal(block[:n], c.Bytes()) {
+		return nil, fmt.Errorf("car block at %d is not %s", offset, c)
+	}
+	return block[n:], nil
+}
+
+// readBlock reads the block with its CID at offset, from the car file written up to end.
+func (cw *CarWriter) readBlock(offset uint64, end uint64) ([]byte, error) {
+	r := bufio.NewReader(io.NewSectionReader(cw.f, int64(offset), int64(end-offset)))
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, size)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// DeleteBlock is not supported, blocks written to the car are kept.
+func (cw *CarWriter) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return errors.New("car writer: blocks cannot be deleted")
+}
+
+// AllKeysChan returns the CIDs of the blocks in the car.
+func (cw *CarWriter) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	cw.lk.RLock()
+	var keys []cid.Cid
+	err := cw.index.keys(func(c cid.Cid) error {
+		keys = append(keys, c)
+		return nil
+	})
+	cw.lk.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan cid.Cid)
+	go func() {
+		defer close(ch)
+		for _, c := range keys {
+			select {
+			case ch <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// HashOnRead is a no-op, blocks are read back as they were written.
+func (cw *CarWriter) HashOnRead(enabled bool) {}
+
+// Size returns the size of the car.
+func (cw *CarWriter) Size() uint64 {
+	cw.lk.RLock()
+	defer cw.lk.RUnlock()
+	return cw.size
+}
+
+// Finish writes the header of root and closes the car. When the root CID is not of the size of the placeholder,
+// as the raw leaf root of a CIDv0 DAG, the blocks are moved after the header and Shift returns how far, the car
+// is then hashed again from the file.
+func (cw *CarWriter) Finish(root cid.Cid) error {
+	cw.lk.Lock()
+	defer cw.lk.Unlock()
+
+	if err := cw.w.Flush(); err != nil {
+		cw.f.Close()
+		return err
+	}
+	header, err := pack.GenerateCarHeader(root)
+	if err != nil {
+		cw.f.Close()
+		return err
+	}
+	moved := uint64(len(header)) != cw.headerSize
+	if moved {
+		if err := cw.moveBlocks(uint64(len(header))); err != nil {
+			cw.f.Close()
+			return err
+		}
+	}
+	if _, err := cw.f.WriteAt(header, 0); err != nil {
+		cw.f.Close()
+		return err
+	}
+
+	if moved {
+		cw.commp = NewCommPWriter()
+		if _, err := io.Copy(cw.commp, io.NewSectionReader(cw.f, 0, int64(cw.size))); err != nil {
+			cw.f.Close()
+			return err
+		}
+	} else if err := cw.commp.Patch(header); err != nil {
+		cw.f.Close()
+		return err
+	}
+	return cw.f.Close()
+}
+
+// CommP returns the commP writer the car is hashed into, it holds the whole car once Finish returned.
+func (cw *CarWriter) CommP() *CommPWriter {
+	cw.lk.RLock()
+	defer cw.lk.RUnlock()
+	return cw.commp
+}
+
+// Shift returns how far the blocks were moved by Finish since they were reported to the callback of OnBlock.
+func (cw *CarWriter) Shift() int64 {
+	cw.lk.RLock()
+	defer cw.lk.RUnlock()
+	return cw.shift
+}
+
+// Close closes the car file, an unfinished car is left with the placeholder root.
+func (cw *CarWriter) Close() error {
+	return cw.f.Close()
+}
+
+// moveBlocks moves the blocks to start at headerSize.
+func (cw *CarWriter) moveBlocks(headerSize uint64) error {
+	body := cw.size - cw.headerSize
+	buf := make([]byte, CAR_WRITER_BUFFER_SIZE)
+	for done := uint64(0); done < body; {
+		n := uint64(len(buf))
+		if n > body-done {
+			n = body - done
+		}
+		// blocks are copied from the end when they move forward, so they are not overwritten before being copied.
+		from := cw.headerSize + done
+		to := headerSize + done
+		if headerSize > cw.headerSize {
+			from = cw.size - done - n
+			to = from + headerSize - cw.headerSize
+		}
+		if _, err := cw.f.ReadAt(buf[:n], int64(from)); err != nil {
+			return err
+		}
+		if _, err := cw.f.WriteAt(buf[:n], int64(to)); err != nil {
+			return err
+		}
+		done += n
+	}
+	if err := cw.f.Truncate(int64(headerSize + body)); err != nil {
+		return err
+	}
+
+	cw.shift += int64(headerSize) - int64(cw.headerSize)
+	cw.size = headerSize + body
+	cw.headerSize = headerSize
+	return nil
+}
@@ -0,0 +1,163 @@
+package metaservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	"gotest.tools/assert"
+)
+
+func readTestCar(t *testing.T) (cid.Cid, []blocks.Block) {
+	f, err := os.Open("../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car")
+	if err != nil {
+		t.Fatalf("Failed to open car : %v", err)
+	}
+	defer f.Close()
+
+	cr, err := car.NewCarReader(f)
+	assert.NilError(t, err)
+	var blks []blocks.Block
+	for {
+		block, err := cr.Next()
+		if err != nil {
+			break
+		}
+		blks = append(blks, block)
+	}
+	return cr.Header.Roots[0], blks
+}
+
+// writeTestCar writes the blocks in reverse order, each twice, and checks the car against them.
+func writeTestCar(t *testing.T, prefix cid.Prefix, root cid.Cid, blks []blocks.Block) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.car")
+	cw, err := NewCarWriter(path, prefix)
+	assert.NilError(t, err)
+	var carBlocks []CarBlock
+	cw.OnBlock(func(block CarBlock) {
+		carBlocks = append(carBlocks, block)
+	})
+
+	var order []blocks.Block
+	for i := len(blks) - 1; i >= 0; i-- {
+		assert.NilError(t, cw.Put(ctx, blks[i]))
+		assert.NilError(t, cw.PutMany(ctx, []blocks.Block{blks[i]}))
+		order = append(order, blks[i])
+
+		// blocks are read back while the car is written.
+		has, err := cw.Has(ctx, blks[i].Cid())
+		assert.NilError(t, err)
+		assert.Assert(t, has)
+		block, err := cw.Get(ctx, blks[len(blks)-1].Cid())
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(block.RawData(), blks[len(blks)-1].RawData()))
+	}
+	assert.NilError(t, cw.Finish(root))
+
+	carBuf, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, cw.Size(), uint64(len(carBuf)))
+
+	// the car is hashed as it was written, with the header of the root.
+	commP, _, err := cw.CommP().Sum()
+	assert.NilError(t, err)
+	expected, _, err := NewCommPCalculator().Sum(bytes.NewReader(carBuf))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, commP, expected)
+
+	cr, err := car.NewCarReader(bytes.NewReader(carBuf))
+	assert.NilError(t, err)
+	assert.Equal(t, len(cr.Header.Roots), 1)
+	assert.Equal(t, cr.Header.Roots[0], root)
+	assert.Equal(t, len(carBlocks), len(blks))
+	for i := range carBlocks {
+		carBlocks[i].Offset = uint64(int64(carBlocks[i].Offset) + cw.Shift())
+	}
+	for i, expected := range order {
+		block, err := cr.Next()
+		assert.NilError(t, err)
+		assert.Equal(t, block.Cid(), expected.Cid())
+		assert.Assert(t, bytes.Equal(block.RawData(), expected.RawData()))
+
+		// the reported boundaries are the length prefix, the CID and the data of the block.
+		cb := carBlocks[i]
+		assert.Equal(t, cb.Cid, expected.Cid())
+		size, n := binary.Uvarint(carBuf[cb.Offset:])
+		assert.Equal(t, cb.Size, uint64(n)+size)
+		assert.Assert(t, bytes.Equal(carBuf[cb.Offset+uint64(n):cb.Offset+cb.Size], append(expected.Cid().Bytes(), expected.RawData()...)))
+	}
+	last := carBlocks[len(carBlocks)-1]
+	assert.Equal(t, last.Offset+last.Size, uint64(len(carBuf)))
+	_, err = cr.Next()
+	assert.Assert(t, err != nil)
+}
+
+func TestCarWriter(t *testing.T) {
+	root, blks := readTestCar(t)
+	writeTestCar(t, merkledag.V1CidPrefix(), root, blks)
+}
+
+func TestCarWriterRootSize(t *testing.T) {
+	root, blks := readTestCar(t)
+
+	// A CIDv1 root is longer than the CIDv0 placeholder, the blocks are moved after the header.
+	writeTestCar(t, merkledag.V0CidPrefix(), root, blks)
+
+	// A CIDv0 root is shorter than the CIDv1 placeholder.
+	v0 := merkledag.V0CidPrefix()
+	v0Root, err := v0.Sum([]byte("root"))
+	assert.NilError(t, err)
+	writeTestCar(t, merkledag.V1CidPrefix(), v0Root, blks)
+}
+
+func TestCarWriterRead(t *testing.T) {
+	ctx := context.Background()
+	prefix := merkledag.V1CidPrefix()
+	prefix.Codec = cid.Raw
+	cw, err := NewCarWriter(filepath.Join(t.TempDir(), "test.car"), prefix)
+	assert.NilError(t, err)
+	defer cw.Close()
+
+	newBlock := func(size int, b byte) blocks.Block {
+		data := bytes.Repeat([]byte{b}, size)
+		c, err := prefix.Sum(data)
+		assert.NilError(t, err)
+		block, err := blocks.NewBlockWithCid(data, c)
+		assert.NilError(t, err)
+		return block
+	}
+	// the start of the large block is written to the file with the buffer, its end stays in the buffer.
+	small := newBlock(100, 1)
+	large := newBlock(CAR_WRITER_BUFFER_SIZE-10, 2)
+	assert.NilError(t, cw.Put(ctx, small))
+	assert.NilError(t, cw.Put(ctx, large))
+	assert.Assert(t, cw.w.Buffered() != 0)
+
+	// a block written to the file is read without flushing the buffer.
+	buffered := cw.w.Buffered()
+	block, err := cw.Get(ctx, small.Cid())
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(block.RawData(), small.RawData()))
+	assert.Equal(t, cw.w.Buffered(), buffered)
+
+	block, err = cw.Get(ctx, large.Cid())
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(block.RawData(), large.RawData()))
+	assert.Equal(t, cw.w.Buffered(), 0)
+
+	// a block in the buffer is flushed to be read.
+	last := newBlock(10, 3)
+	assert.NilError(t, cw.Put(ctx, last))
+	block, err = cw.Get(ctx, last.Cid())
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(block.RawData(), last.RawData()))
+	assert.Equal(t, cw.w.Buffered(), 0)
+}
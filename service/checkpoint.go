@@ -0,0 +1,316 @@
+package metaservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dataswap/go-metadata/types"
+	"github.com/dataswap/go-metadata/utils"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	CHECKPOINT_META_FILE  = "checkpoint.json"
+	CHECKPOINT_FILES_FILE = "files.jsonl"
+	// default interval between two syncs of the checkpoint to the disk
+	CHECKPOINT_INTERVAL = time.Minute
+)
+
+// CheckpointMeta identifies the run a checkpoint belongs to, only a run with the same inputs and DAG parameters resumes it.
+type CheckpointMeta struct {
+	Inputs        []string        `json:"inputs"`        // input paths
+	Parent        string          `json:"parent"`        // source parent path
+	HamtThreshold int             `json:"hamtthreshold"` // directory size above which directories are sharded
+	Params        types.DagParams `json:"params"`        // DAG parameters
+}
+
+// CheckpointMapping is a mapping of a checkpointed file with the size of the data of its block.
+type CheckpointMapping struct {
+	*types.ChunkMapping
+	RawSize uint64 `json:"rawsize"`
+}
+
+// CheckpointFile is the DAG of a source file, or of a range of it, completed by a run.
+type CheckpointFile struct {
+	Path     string               `json:"path"`    // source file path
+	Offset   uint64               `json:"offset"`  // offset of the range in the file
+	Size     uint64               `json:"size"`    // size of the range
+	ModTime  int64                `json:"modtime"` // modification time of the file in unix nanoseconds
+	Root     cid.Cid              `json:"root"`    // root of the DAG
+	Mappings []*CheckpointMapping `json:"mappings"`
+}
+
+type checkpointKey struct {
+	path    string
+	offset  uint64
+	size    uint64
+	modTime int64
+}
+
+func (f *CheckpointFile) key() checkpointKey {
+	return checkpointKey{path: f.Path, offset: f.Offset, size: f.Size, modTime: f.ModTime}
+}
+
+// Checkpoint records the DAGs of the files completed by a run in a directory, so a restarted run resumes after them
+// instead of hashing them again. Completed files are appended to a log which is synced to the disk every interval.
+// Only the position of their records is kept in memory, a file is read back from the log when it is resumed.
+type Checkpoint struct {
+	path     string
+	meta     *CheckpointMeta
+	interval time.Duration
+
+	lk     sync.Mutex
+	files  map[checkpointKey]checkpointRecord
+	log    *os.File
+	end    int64 // end of the complete records of the log
+	synced time.Time
+}
+
+// checkpointRecord is the position of the record of a completed file in the log.
+type checkpointRecord struct {
+	offset int64
+	size   int64
+}
+
+// OpenCheckpoint opens the checkpoint under path, or creates it. An existing checkpoint of another run is an error.
+func OpenCheckpoint(path string, meta *CheckpointMeta, interval time.Duration) (*Checkpoint, error) {
+	if err := os.MkdirAll(path, 0o775); err != nil {
+		return nil, err
+	}
+
+	metaPath := filepath.Join(path, CHECKPOINT_META_FILE)
+	if utils.PathExists(metaPath) {
+		var recorded CheckpointMeta
+		if err := utils.ReadJson(metaPath, &recorded); err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(&recorded, meta) {
+			return nil, fmt.Errorf("checkpoint %s belongs to a run with other inputs or flags, remove it to start over", path)
+		}
+	} else if err := utils.WriteJson(metaPath, "\t", meta); err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(path, CHECKPOINT_FILES_FILE), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{
+		path:     path,
+		meta:     meta,
+		interval: interval,
+		files:    make(map[checkpointKey]checkpointRecord),
+		log:      log,
+		synced:   time.Now(),
+	}
+	if err := cp.load(); err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// load reads the completed files of the log. A last record cut short by a crash is dropped.
+func (cp *Checkpoint) load() error {
+	r := bufio.NewReader(cp.log)
+	var end int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var f CheckpointFile
+		if err := json.Unmarshal(bytes.TrimSpace(line), &f); err != nil {
+			return fmt.Errorf("checkpoint %s has a malformed record at %d: %w", cp.path, end, err)
+		}
+		cp.files[f.key()] = checkpointRecord{offset: end, size: int64(len(line))}
+		end += int64(len(line))
+	}
+
+	if err := cp.log.Truncate(end); err != nil {
+		return err
+	}
+	cp.end = end
+	_, err := cp.log.Seek(end, io.SeekStart)
+	return err
+}
+
+// Len returns the number of completed files.
+func (cp *Checkpoint) Len() int {
+	cp.lk.Lock()
+	defer cp.lk.Unlock()
+	return len(cp.files)
+}
+
+// File returns the completed DAG of the range of the source file, nil if it has to be built.
+// A record which cannot be read back is built again as well, and so is a file whose last leaf does not hash to the
+// recorded one any more, as when it was modified in place without changing its size nor its modification time.
+func (cp *Checkpoint) File(path string, offset uint64, size uint64, modTime time.Time) *CheckpointFile {
+	cp.lk.Lock()
+	record, ok := cp.files[checkpointKey{path: path, offset: offset, size: size, modTime: modTime.UnixNano()}]
+	cp.lk.Unlock()
+	if !ok {
+		return nil
+	}
+
+	line := make([]byte, record.size)
+	if _, err := cp.log.ReadAt(line, record.offset); err != nil {
+		return nil
+	}
+	var f CheckpointFile
+	if err := json.Unmarshal(line, &f); err != nil {
+		return nil
+	}
+	if err := f.checkLastLeaf(cp.meta.Parent, cp.meta.Params); err != nil {
+		return nil
+	}
+	return &f
+}
+
+// AddFile records the completed DAG of a file.
+func (cp *Checkpoint) AddFile(f *CheckpointFile) error {
+	line, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	cp.lk.Lock()
+	defer cp.lk.Unlock()
+	// A single write, so a crash leaves at most the last record incomplete.
+	if _, err := cp.log.Write(line); err != nil {
+		return err
+	}
+	cp.files[f.key()] = checkpointRecord{offset: cp.end, size: int64(len(line))}
+	cp.end += int64(len(line))
+
+	if time.Since(cp.synced) >= cp.interval {
+		if err := cp.log.Sync(); err != nil {
+			return err
+		}
+		cp.synced = time.Now()
+	}
+	return nil
+}
+
+// Close syncs and closes the checkpoint.
+func (cp *Checkpoint) Close() error {
+	cp.lk.Lock()
+	defer cp.lk.Unlock()
+	if err := cp.log.Sync(); err != nil {
+		cp.log.Close()
+		return err
+	}
+	return cp.log.Close()
+}
+
+// Remove closes and deletes the checkpoint, once the run it belongs to is done.
+func (cp *Checkpoint) Remove() error {
+	if err := cp.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(cp.path)
+}
+
+// Nodes rebuilds the nodes of the DAG of the file from its mappings and the source data under srcParent.
+// The nodes get the recorded CIDs, their data is read but not hashed again. They are visited once each in
+// post-order from the root, the order the importer adds them in, so they are written to the car as when built.
+func (f *CheckpointFile) Nodes(srcParent string, params types.DagParams, visit func(node ipld.Node, m *types.ChunkMapping) error) error {
+	ms := New(DagParams(params))
+	ms.RecordCheckpointFile(f)
+	reader := NewLocalSourceReader(srcParent)
+
+	visited := make(map[cid.Cid]struct{}, len(f.Mappings))
+	var walk func(c cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if _, ok := visited[c]; ok {
+			return nil
+		}
+		visited[c] = struct{}{}
+
+		m, ok := ms.mappings[c]
+		if !ok {
+			return fmt.Errorf("checkpointed file %s has no mapping of %s", f.Path, c)
+		}
+		for _, link := range m.Links {
+			if err := walk(link.Cid); err != nil {
+				return err
+			}
+		}
+		node, err := ms.generateNode(reader, m, recordedCid{c})
+		if err != nil {
+			return err
+		}
+		return visit(node, m)
+	}
+	return walk(f.Root)
+}
+
+// checkLastLeaf hashes the last leaf of the file again from the source data under srcParent.
+func (f *CheckpointFile) checkLastLeaf(srcParent string, params types.DagParams) error {
+	var last *types.ChunkMapping
+	for _, m := range f.Mappings {
+		if m.SrcPath != "" && (last == nil || m.SrcOffset > last.SrcOffset) {
+			last = m.ChunkMapping
+		}
+	}
+	// an empty file has no data to check.
+	if last == nil {
+		return nil
+	}
+	ms := New(DagParams(params))
+	_, err := ms.generateNodeFromReader(NewLocalSourceReader(srcParent), last, last.Cid.Prefix())
+	return err
+}
+
+// CheckpointMappings returns the mappings recorded so far with the sizes of the data of their blocks.
+func (ms *MappingService) CheckpointMappings() []*CheckpointMapping {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+
+	mappings := make([]*CheckpointMapping, 0, len(ms.mappings))
+	for c, m := range ms.mappings {
+		mappings = append(mappings, &CheckpointMapping{ChunkMapping: m, RawSize: ms.chunkRawSize[c]})
+	}
+	return mappings
+}
+
+// RecordCheckpointFile adds the mappings of a checkpointed file, as if its DAG was built again.
+// As when building, the mappings of blocks already recorded are kept.
+func (ms *MappingService) RecordCheckpointFile(f *CheckpointFile) {
+	for _, m := range f.Mappings {
+		cm := *m.ChunkMapping
+		ms.insertMapping(cm.Cid, &cm, m.RawSize)
+	}
+}
+
+// recordedCid is a cid.Builder returning the CID recorded for a node instead of hashing its data.
+type recordedCid struct {
+	c cid.Cid
+}
+
+func (r recordedCid) Sum(data []byte) (cid.Cid, error) {
+	return r.c, nil
+}
+
+func (r recordedCid) GetCodec() uint64 {
+	return r.c.Type()
+}
+
+func (r recordedCid) WithCodec(codec uint64) cid.Builder {
+	return r
+}
@@ -0,0 +1,151 @@
+package metaservice
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dataswap/go-metadata/libs"
+	"github.com/dataswap/go-metadata/types"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"gotest.tools/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	meta := &CheckpointMeta{
+		Inputs: []string{"../testdata/input"},
+		Parent: "../testdata",
+		Params: New().DagParams(),
+	}
+
+	ms := New()
+	if err := ms.LoadMetaMappings("../testdata/output/metas/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.json"); err != nil {
+		t.Fatalf("Failed to load mappings: %v", err)
+	}
+	modTime := time.Now()
+	f := &CheckpointFile{
+		Path:     "../testdata/input/test.txt",
+		Size:     2855,
+		ModTime:  modTime.UnixNano(),
+		Root:     ms.DataRoot(),
+		Mappings: ms.CheckpointMappings(),
+	}
+
+	cp, err := OpenCheckpoint(path, meta, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, cp.Len(), 0)
+	assert.NilError(t, cp.AddFile(f))
+	assert.NilError(t, cp.Close())
+
+	// A record cut short by a crash is dropped when the checkpoint is resumed.
+	log, err := os.OpenFile(filepath.Join(path, CHECKPOINT_FILES_FILE), os.O_WRONLY|os.O_APPEND, 0o644)
+	assert.NilError(t, err)
+	_, err = log.WriteString(`{"path":"../testdata/input/te`)
+	assert.NilError(t, err)
+	log.Close()
+
+	cp, err = OpenCheckpoint(path, meta, time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, cp.Len(), 1)
+	assert.Assert(t, cp.File(f.Path, 0, f.Size, modTime.Add(time.Second)) == nil)
+	resumed := cp.File(f.Path, 0, f.Size, modTime)
+	assert.Assert(t, resumed != nil)
+	assert.Equal(t, resumed.Root, f.Root)
+	assert.Equal(t, len(resumed.Mappings), len(f.Mappings))
+
+	// Records added after resuming follow the complete ones.
+	g := *f
+	g.Path = "../testdata/input/test1.txt"
+	assert.NilError(t, cp.AddFile(&g))
+	assert.NilError(t, cp.Close())
+	cp, err = OpenCheckpoint(path, meta, time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, cp.Len(), 2)
+
+	// Only a run with the same inputs and parameters resumes the checkpoint.
+	other := *meta
+	other.Params.RawLeaves = true
+	_, err = OpenCheckpoint(path, &other, time.Hour)
+	assert.ErrorContains(t, err, "other inputs or flags")
+
+	assert.NilError(t, cp.Remove())
+	_, err = os.Stat(path)
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestCheckpointFileNodes(t *testing.T) {
+	ms := New()
+	if err := ms.LoadMetaMappings("../testdata/output/metas/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.json"); err != nil {
+		t.Fatalf("Failed to load mappings: %v", err)
+	}
+	f := &CheckpointFile{Root: ms.DataRoot(), Mappings: ms.CheckpointMappings()}
+
+	// The nodes rebuilt with their recorded CIDs are the nodes rebuilt and checked from the source data.
+	reader := NewLocalSourceReader("../testdata")
+	var n int
+	err := f.Nodes("../testdata", ms.DagParams(), func(node ipld.Node, m *types.ChunkMapping) error {
+		expected, err := ms.generateNode(reader, m, ms.CidBuilder())
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, node.Cid(), expected.Cid())
+		assert.Assert(t, bytes.Equal(node.RawData(), expected.RawData()))
+		n++
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, n, len(f.Mappings))
+
+	// Mappings recorded from the checkpoint are the ones of the file.
+	rms := New()
+	rms.RecordCheckpointFile(f)
+	all, err := rms.GetAllChunkMappings()
+	assert.NilError(t, err)
+	assert.Equal(t, len(all), len(f.Mappings))
+}
+
+func TestCheckpointModifiedFile(t *testing.T) {
+	dir := t.TempDir()
+	params := types.DagParams{Prefix: merkledag.V1CidPrefix(), Chunker: "size-256", Layout: libs.BalancedLayout, RawLeaves: true, MaxLinks: 3}
+	meta := &CheckpointMeta{Inputs: []string{dir}, Parent: dir, Params: params}
+
+	data := make([]byte, 4000)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(dir, "file")
+	assert.NilError(t, os.WriteFile(path, data, 0o644))
+	stat, err := os.Stat(path)
+	assert.NilError(t, err)
+
+	fms := New(DagParams(params))
+	discard := bstore.NewBlockstore(dssync.MutexWrap(datastore.NewNullDatastore()))
+	root, err := buildTestFile(path, dir, merkledag.NewDAGService(blockservice.New(discard, offline.Exchange(discard))), params, fms)
+	assert.NilError(t, err)
+
+	cp, err := OpenCheckpoint(filepath.Join(t.TempDir(), "checkpoint"), meta, time.Hour)
+	assert.NilError(t, err)
+	defer cp.Close()
+	assert.NilError(t, cp.AddFile(&CheckpointFile{
+		Path:     path,
+		Size:     uint64(stat.Size()),
+		ModTime:  stat.ModTime().UnixNano(),
+		Root:     root,
+		Mappings: fms.CheckpointMappings(),
+	}))
+	assert.Assert(t, cp.File(path, 0, uint64(stat.Size()), stat.ModTime()) != nil)
+
+	// The end of the file modified in place, with the same size and modification time, is built again.
+	data[len(data)-1]++
+	assert.NilError(t, os.WriteFile(path, data, 0o644))
+	assert.NilError(t, os.Chtimes(path, stat.ModTime(), stat.ModTime()))
+	assert.Assert(t, cp.File(path, 0, uint64(stat.Size()), stat.ModTime()) == nil)
+}
@@ -0,0 +1,87 @@
+package metaservice
+
+import (
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ChunkProvider provides the data of a range of a car, the challenge proofs are generated from it.
+// Implementations must be safe for concurrent use.
+type ChunkProvider interface {
+	// GetChunk returns size bytes of the car of the piece commCid from offset on, less at the end of the car.
+	GetChunk(commCid cid.Cid, offset uint64, size uint64) ([]byte, error)
+}
+
+// MappingChunkProvider rebuilds the car chunks from the mapping files and the source data. The mapping file of a
+// piece is loaded once, by the first chunk of the piece, and kept for the chunks after it.
+type MappingChunkProvider struct {
+	opts []Option
+
+	lk   sync.Mutex
+	cars map[cid.Cid]*mappingCar
+}
+
+// mappingCar is the car of a piece rebuilt from its mapping file, loaded once.
+type mappingCar struct {
+	once sync.Once
+	vc   *VirtualCar
+	err  error
+}
+
+var _ ChunkProvider = (*MappingChunkProvider)(nil)
+
+// NewMappingChunkProvider creates a MappingChunkProvider, the MetaPath and SourceParentPath options locate
+// the mapping files and the source data.
+func NewMappingChunkProvider(opts ...Option) *MappingChunkProvider {
+	return &MappingChunkProvider{opts: opts, cars: make(map[cid.Cid]*mappingCar)}
+}
+
+// GetChunk rebuilds a car chunk from the VirtualCar of its piece, every piece has a MappingService of its own,
+// so chunks of any dataset can be rebuilt concurrently.
+func (p *MappingChunkProvider) GetChunk(commCid cid.Cid, offset uint64, size uint64) ([]byte, error) {
+	p.lk.Lock()
+	car, ok := p.cars[commCid]
+	if !ok {
+		car = &mappingCar{}
+		p.cars[commCid] = car
+	}
+	p.lk.Unlock()
+
+	car.once.Do(func() {
+		car.vc, car.err = New(p.opts...).PieceVirtualCar(commCid)
+	})
+	if car.err != nil {
+		return nil, car.err
+	}
+
+	buf := make([]byte, size)
+	n, err := car.vc.ReadAt(buf, int64(offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// CarChunkProvider reads the car chunks from the car, every chunk is of the same car whichever the piece.
+type CarChunkProvider struct {
+	r io.ReaderAt
+}
+
+var _ ChunkProvider = (*CarChunkProvider)(nil)
+
+// NewCarChunkProvider creates a CarChunkProvider reading the car from r, e.g. an *os.File.
+func NewCarChunkProvider(r io.ReaderAt) *CarChunkProvider {
+	return &CarChunkProvider{r: r}
+}
+
+// GetChunk reads the car chunk, it is short at the end of the car.
+func (p *CarChunkProvider) GetChunk(commCid cid.Cid, offset uint64, size uint64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := p.r.ReadAt(buf, int64(offset))
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
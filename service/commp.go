@@ -0,0 +1,354 @@
+package metaservice
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/bits"
+	"sync/atomic"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/ipfs/go-cid"
+	mt "github.com/txaty/go-merkletree"
+)
+
+// number of source chunks expanded into leaves at once
+const COMMP_WRITER_BATCH_CHUNKS = 4096
+
+// CommPCalculator computes the commP of cars. It owns the nul padding of the tree and counts the source chunks it
+// padded, the state of a computation is held by the writer it creates, so it is used from many goroutines at once.
+type CommPCalculator struct {
+	nulPadding [MaxLayers][]byte
+	chunks     atomic.Uint64 // source chunks padded by all the computations
+}
+
+// the calculator of the package level functions
+var defaultCommPCalculator = NewCommPCalculator()
+
+// NewCommPCalculator creates a CommPCalculator.
+func NewCommPCalculator() *CommPCalculator {
+	return &CommPCalculator{nulPadding: newStackedNulPadding()}
+}
+
+// NewWriter creates a CommPWriter padding the data written to it with c.
+func (c *CommPCalculator) NewWriter() *CommPWriter {
+	return &CommPWriter{
+		calc: c,
+		buf:  make([]byte, 0, SOURCE_CHUNK_SIZE*COMMP_WRITER_BATCH_CHUNKS),
+		keep: CarCacheLayerStart(0),
+	}
+}
+
+// Sum returns the commP and the padded piece size of the data read from r.
+func (c *CommPCalculator) Sum(r io.Reader) ([]byte, uint64, error) {
+	w := c.NewWriter()
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, 0, err
+	}
+	return w.Sum()
+}
+
+// DataPadding expands the source chunks of inSlab as DataPadding, counting them.
+func (c *CommPCalculator) DataPadding(inSlab []byte) []byte {
+	c.chunks.Add(uint64(len(inSlab) / SOURCE_CHUNK_SIZE))
+	return DataPadding(inSlab)
+}
+
+// ChunkCount returns the number of source chunks padded by c.
+func (c *CommPCalculator) ChunkCount() uint64 {
+	return c.chunks.Load()
+}
+
+// PaddedDataBlocks pads the data of buf to whole source chunks and expands them into the leaves of the tree,
+// padded with zero leaves to targetPaddedSize, 0 for the default padded size. It returns the leaves with their
+// padded size.
+func (c *CommPCalculator) PaddedDataBlocks(buf bytes.Buffer, targetPaddedSize uint64) ([]mt.DataBlock, uint64, error) {
+	srcLen := buf.Len()
+
+	// Padding source data
+	if mod := srcLen % SOURCE_CHUNK_SIZE; mod != 0 {
+		buf.Write(make([]byte, SOURCE_CHUNK_SIZE-mod))
+		srcLen = buf.Len()
+	}
+
+	// Struce blocks from source data
+	idx := 0
+	blocks := make([]mt.DataBlock, srcLen*CHUNK_NODES_NUM/SOURCE_CHUNK_SIZE)
+	for j := 0; j < srcLen/SOURCE_CHUNK_SIZE; j++ {
+		nodes := c.DataPadding(buf.Bytes()[j*SOURCE_CHUNK_SIZE : (j+1)*SOURCE_CHUNK_SIZE])
+		for b := 0; b < CHUNK_NODES_NUM; b++ {
+			block := &DataBlock{
+				Data: nodes[b*NODE_SIZE : (b+1)*NODE_SIZE],
+			}
+			blocks[idx] = block
+			idx++
+		}
+	}
+
+	sourcePaddedSize := uint64((srcLen / SOURCE_CHUNK_SIZE) * SLAB_CHUNK_SIZE)
+	if targetPaddedSize != 0 {
+		blocks, err := c.paddedDataBlocks(blocks, sourcePaddedSize, targetPaddedSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		return blocks, targetPaddedSize, nil
+	}
+
+	return blocks, sourcePaddedSize, nil
+}
+
+// CommPWriter computes the commP of the data written to it and the level cache of its Merkle tree
+// without holding the data in memory. It produces the same root, piece size and level cache as
+// GenCommP with a zero targetPaddedSize.
+type CommPWriter struct {
+	calc   *CommPCalculator
+	size   uint64 // bytes written
+	buf    []byte // written bytes not yet expanded into leaves
+	leaves uint64 // number of leaves
+
+	// per tree level, the left node waiting for its sibling and the number of nodes.
+	pending [][]byte
+	counts  []uint64
+	// per tree level from keep on, all the nodes, so the level cache can be built.
+	nodes [][][]byte
+	keep  int
+	pair  [2 * NODE_SIZE]byte
+	// the first source chunk and, per tree level, the right sibling of the first node, so Patch hashes the left
+	// edge of the tree again.
+	first    []byte
+	siblings [][]byte
+
+	root  []byte
+	depth int
+}
+
+// NewCommPWriter creates a CommPWriter of the default calculator.
+func NewCommPWriter() *CommPWriter {
+	return defaultCommPCalculator.NewWriter()
+}
+
+// Write expands p into commP leaves and hashes them into the tree.
+func (w *CommPWriter) Write(p []byte) (int, error) {
+	if w.root != nil {
+		return 0, errors.New("commP writer is already summed")
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		if len(w.buf) == cap(w.buf) {
+			w.flush()
+		}
+	}
+	w.size += uint64(n)
+
+	// only the levels of the final cache layer need to be kept.
+	if start := CarCacheLayerStart(w.size); start > w.keep {
+		for level := w.keep; level < start && level < len(w.nodes); level++ {
+			w.nodes[level] = nil
+		}
+		w.keep = start
+	}
+
+	return n, nil
+}
+
+// Size returns the number of bytes written.
+func (w *CommPWriter) Size() uint64 {
+	return w.size
+}
+
+// Sum pads the tree and returns the commP and the padded piece size. No more data can be written afterwards.
+func (w *CommPWriter) Sum() ([]byte, uint64, error) {
+	if w.root == nil {
+		if err := w.finish(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return w.root, PaddedPieceSize(w.size), nil
+}
+
+// PaddedPieceSize returns the padded size of the piece of carSize bytes of data.
+func PaddedPieceSize(carSize uint64) uint64 {
+	// every source chunk is padded to a slab, round up to the next power of 2.
+	paddedPieceSize := (carSize + SOURCE_CHUNK_SIZE - 1) / SOURCE_CHUNK_SIZE * SLAB_CHUNK_SIZE
+	if bits.OnesCount64(paddedPieceSize) != 1 {
+		paddedPieceSize = 1 << uint(64-bits.LeadingZeros64(paddedPieceSize))
+	}
+	return paddedPieceSize
+}
+
+// LevelCache returns the level cache of the tree from CarCacheLayerStart of the written size on.
+func (w *CommPWriter) LevelCache() (*mt.LevelCache, error) {
+	if _, _, err := w.Sum(); err != nil {
+		return nil, err
+	}
+
+	start := CarCacheLayerStart(w.size)
+	if start > w.depth {
+		return nil, errors.New("the tree is lower than the cache layer start")
+	}
+
+	lc := &mt.LevelCache{
+		LeafMap: make(map[string]int),
+		Nodes:   w.nodes[start:w.depth],
+		Start:   start,
+		Level:   w.depth - start,
+	}
+	if lc.Level > 0 {
+		for i := 0; i < int(w.leaves>>start); i++ {
+			lc.LeafMap[string(lc.Nodes[0][i])] = i
+		}
+	}
+
+	return lc, nil
+}
+
+// PieceCid returns the commP as a piece CID.
+func (w *CommPWriter) PieceCid() (cid.Cid, error) {
+	rawCommP, _, err := w.Sum()
+	if err != nil {
+		return cid.Undef, err
+	}
+	return commcid.DataCommitmentV1ToCID(rawCommP)
+}
+
+// StoreLevelCache stores the level cache under cachePath, named by the piece CID as GenChallengeProof loads it.
+func (w *CommPWriter) StoreLevelCache(cachePath string) error {
+	lc, err := w.LevelCache()
+	if err != nil {
+		return err
+	}
+	commCid, err := w.PieceCid()
+	if err != nil {
+		return err
+	}
+	return lc.StoreToFile(createPath(cachePath, commCid.String()+CACHE_SUFFIX))
+}
+
+// Patch replaces the first len(head) bytes written with head, as the header of a car written with a placeholder
+// root is patched once its blocks are written. head must fit in the first source chunk, the nodes of the chunk are
+// hashed again up the left edge of the tree.
+func (w *CommPWriter) Patch(head []byte) error {
+	if len(head) > SOURCE_CHUNK_SIZE {
+		return errors.New("the patched head is longer than a source chunk")
+	}
+	if uint64(len(head)) > w.size {
+		return errors.New("the patched head is longer than the written data")
+	}
+	if w.leaves == 0 {
+		// the first source chunk is not expanded yet.
+		copy(w.buf, head)
+		return nil
+	}
+
+	copy(w.first, head)
+	padded := DataPadding(w.first)
+	layer := make([][]byte, CHUNK_NODES_NUM)
+	for i := range layer {
+		layer[i] = padded[i*NODE_SIZE : (i+1)*NODE_SIZE]
+	}
+	for level := 0; ; level++ {
+		if level >= w.keep && level < len(w.nodes) {
+			copy(w.nodes[level], layer)
+		}
+		if len(layer) > 1 {
+			// the nodes of the chunk are hashed together up to its root.
+			parents := make([][]byte, len(layer)/2)
+			for i := range parents {
+				parents[i], _ = NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), layer[2*i]...), layer[2*i+1]...))
+			}
+			layer = parents
+			continue
+		}
+
+		// the first node of a level with no sibling yet is waiting for it, it is the root once summed.
+		if w.counts[level] == 1 {
+			w.pending[level] = layer[0]
+			if w.root != nil && level == w.depth {
+				w.root = layer[0]
+			}
+			return nil
+		}
+		parent, _ := NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), layer[0]...), w.siblings[level]...))
+		layer[0] = parent
+	}
+}
+
+// flush expands the buffered source chunks into leaves.
+func (w *CommPWriter) flush() {
+	chunks := len(w.buf) / SOURCE_CHUNK_SIZE
+	if chunks == 0 {
+		return
+	}
+	if w.leaves == 0 {
+		w.first = append([]byte(nil), w.buf[:SOURCE_CHUNK_SIZE]...)
+	}
+
+	nodes := w.calc.DataPadding(w.buf[:chunks*SOURCE_CHUNK_SIZE])
+	for i := 0; i < chunks*CHUNK_NODES_NUM; i++ {
+		w.push(0, nodes[i*NODE_SIZE:(i+1)*NODE_SIZE])
+	}
+	w.leaves += uint64(chunks * CHUNK_NODES_NUM)
+
+	w.buf = w.buf[:copy(w.buf, w.buf[chunks*SOURCE_CHUNK_SIZE:])]
+}
+
+// push adds a node to a level, hashing it with its left sibling into the level above.
+func (w *CommPWriter) push(level int, node []byte) {
+	for len(w.counts) <= level {
+		w.counts = append(w.counts, 0)
+		w.pending = append(w.pending, nil)
+		w.nodes = append(w.nodes, nil)
+		w.siblings = append(w.siblings, nil)
+	}
+
+	w.counts[level]++
+	if level >= w.keep {
+		w.nodes[level] = append(w.nodes[level], node)
+	}
+	if w.counts[level] == 2 {
+		w.siblings[level] = node
+	}
+
+	if w.counts[level]%2 == 1 {
+		w.pending[level] = node
+		return
+	}
+
+	copy(w.pair[:NODE_SIZE], w.pending[level])
+	copy(w.pair[NODE_SIZE:], node)
+	w.pending[level] = nil
+	parent, _ := NewHashFunc(w.pair[:])
+	w.push(level+1, parent)
+}
+
+// finish zero pads the source data to a whole chunk and pads every odd level with the nul node of its height.
+func (w *CommPWriter) finish() error {
+	if mod := len(w.buf) % SOURCE_CHUNK_SIZE; mod != 0 {
+		w.buf = append(w.buf, make([]byte, SOURCE_CHUNK_SIZE-mod)...)
+	}
+	w.flush()
+
+	if w.leaves == 0 {
+		return errors.New("the number of data blocks must be greater than 0")
+	}
+
+	for level := 0; ; level++ {
+		top := len(w.counts) - 1
+		if level == top && w.counts[level] == 1 {
+			break
+		}
+		if w.counts[level]%2 == 1 {
+			w.push(level, w.calc.nulPadding[level])
+		}
+	}
+
+	// the root is the only node of the top level, it is left waiting for a sibling.
+	w.depth = len(w.counts) - 1
+	w.root = w.pending[w.depth]
+	return nil
+}
@@ -0,0 +1,192 @@
+package metaservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/v2/blockstore"
+	mt "github.com/txaty/go-merkletree"
+	"gotest.tools/assert"
+)
+
+func TestCommPWriter(t *testing.T) {
+	p := map[string]string{"../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car": "bafybeiekw7iaz4zjgfq3gdcyh2zh77m3j5ns75w7lyu5nqq3bgoccjgzmq",
+		"../testdata/output/baga6ea4seaqkq2y6yhslmwrm4472d4qkzqubeki73z3qeei23e6bejuzjdxiygy.car": "bafybeicdsaojbbmf3dum3abtpdfvnm5vjan2yobzh74d22qxwklc64tzce"}
+
+	for k, v := range p {
+		bs, err := blockstore.OpenReadOnly(k)
+		assert.NilError(t, err)
+
+		root, err := cid.Parse(v)
+		assert.NilError(t, err)
+
+		sc := car.NewSelectiveCar(context.Background(), bs, []car.Dag{{Root: root, Selector: allSelector()}})
+		buf := bytes.Buffer{}
+		assert.NilError(t, sc.Write(&buf))
+
+		checkCommPWriter(t, buf.Bytes(), 1000)
+	}
+}
+
+func TestCommPWriterLargeCar(t *testing.T) {
+	// larger than CAR_2MIB_CHUNK_SIZE, the cache starts at layer 16.
+	data := make([]byte, 3*CAR_2MIB_CHUNK_SIZE/2+13)
+	_, err := rand.Read(data)
+	assert.NilError(t, err)
+
+	checkCommPWriter(t, data, 65537)
+}
+
+func TestCommPWriterPatch(t *testing.T) {
+	// the head is in the buffered chunks, in the expanded leaves, and in a tree of the 2MiB cache layer.
+	for _, size := range []int{1000, SOURCE_CHUNK_SIZE*COMMP_WRITER_BATCH_CHUNKS + 1, int(3*CAR_2MIB_CHUNK_SIZE/2 + 13)} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		assert.NilError(t, err)
+		head := data[:59]
+		expected := NewCommPWriter()
+		_, err = expected.Write(data)
+		assert.NilError(t, err)
+		expectedLc, err := expected.LevelCache()
+		assert.NilError(t, err)
+
+		// the head is patched before or after the sum.
+		for _, summed := range []bool{false, true} {
+			w := NewCommPWriter()
+			_, err = w.Write(make([]byte, len(head)))
+			assert.NilError(t, err)
+			_, err = w.Write(data[len(head):])
+			assert.NilError(t, err)
+			if summed {
+				_, _, err = w.Sum()
+				assert.NilError(t, err)
+			}
+			assert.NilError(t, w.Patch(head))
+
+			commP, pieceSize, err := w.Sum()
+			assert.NilError(t, err)
+			expectedCommP, expectedPieceSize, _ := expected.Sum()
+			assert.DeepEqual(t, commP, expectedCommP)
+			assert.Equal(t, pieceSize, expectedPieceSize)
+			lc, err := w.LevelCache()
+			assert.NilError(t, err)
+			assert.DeepEqual(t, lc.Nodes, expectedLc.Nodes)
+			assert.DeepEqual(t, lc.LeafMap, expectedLc.LeafMap)
+		}
+	}
+
+	w := NewCommPWriter()
+	_, err := w.Write(make([]byte, 10))
+	assert.NilError(t, err)
+	assert.ErrorContains(t, w.Patch(make([]byte, 11)), "longer than the written data")
+	assert.ErrorContains(t, w.Patch(make([]byte, SOURCE_CHUNK_SIZE+1)), "longer than a source chunk")
+}
+
+func checkCommPWriter(t *testing.T, data []byte, writeSize int) {
+	cachePath := t.TempDir()
+
+	rawCommP, pieceSize, err := GenCommP(*bytes.NewBuffer(data), cachePath, 0)
+	assert.NilError(t, err)
+	commCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	assert.NilError(t, err)
+	expected, err := mt.NewLevelCacheFromFile(path.Join(cachePath, commCid.String()+CACHE_SUFFIX))
+	assert.NilError(t, err)
+
+	w := NewCommPWriter()
+	for rest := data; len(rest) > 0; {
+		n := writeSize
+		if n > len(rest) {
+			n = len(rest)
+		}
+		_, err := w.Write(rest[:n])
+		assert.NilError(t, err)
+		rest = rest[n:]
+	}
+
+	streamCommP, streamPieceSize, err := w.Sum()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, streamCommP, rawCommP)
+	assert.Equal(t, streamPieceSize, pieceSize)
+
+	cp := new(commp.Calc)
+	cp.Write(data)
+	refCommP, refPieceSize, err := cp.Digest()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, streamCommP, refCommP)
+	assert.Equal(t, streamPieceSize, refPieceSize)
+
+	streamPath := t.TempDir()
+	assert.NilError(t, w.StoreLevelCache(streamPath))
+	lc, err := mt.NewLevelCacheFromFile(path.Join(streamPath, commCid.String()+CACHE_SUFFIX))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, lc.Start, expected.Start)
+	assert.DeepEqual(t, lc.Level, expected.Level)
+	assert.DeepEqual(t, lc.Nodes, expected.Nodes)
+	assert.DeepEqual(t, lc.LeafMap, expected.LeafMap)
+}
+
+func TestCommPCalculatorConcurrent(t *testing.T) {
+	var inputs [][]byte
+	for _, path := range []string{
+		"../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car",
+		"../testdata/output/baga6ea4seaqkq2y6yhslmwrm4472d4qkzqubeki73z3qeei23e6bejuzjdxiygy.car",
+	} {
+		data, err := os.ReadFile(path)
+		assert.NilError(t, err)
+		inputs = append(inputs, data)
+	}
+	for _, size := range []uint64{127 * 3, 65537, CAR_2MIB_CHUNK_SIZE + 1} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		assert.NilError(t, err)
+		inputs = append(inputs, data)
+	}
+
+	// Every car is hashed several times at once, streamed and as padded data blocks, with a single calculator.
+	const rounds = 4
+	calc := NewCommPCalculator()
+	var expectedChunks uint64
+	var wg sync.WaitGroup
+	for _, data := range inputs {
+		cp := new(commp.Calc)
+		cp.Write(data)
+		refCommP, refPieceSize, err := cp.Digest()
+		assert.NilError(t, err)
+		expectedChunks += 2 * rounds * ((uint64(len(data)) + SOURCE_CHUNK_SIZE - 1) / SOURCE_CHUNK_SIZE)
+
+		for i := 0; i < rounds; i++ {
+			wg.Add(2)
+			go func(data []byte) {
+				defer wg.Done()
+				rawCommP, pieceSize, err := calc.Sum(bytes.NewReader(data))
+				if err != nil || !bytes.Equal(rawCommP, refCommP) || pieceSize != refPieceSize {
+					t.Errorf("streamed commP of %d bytes: %x %d %v, expected %x %d", len(data), rawCommP, pieceSize, err, refCommP, refPieceSize)
+				}
+			}(data)
+			go func(data []byte) {
+				defer wg.Done()
+				blocks, _, err := calc.PaddedDataBlocks(*bytes.NewBuffer(append([]byte(nil), data...)), 0)
+				if err != nil {
+					t.Errorf("padded data blocks of %d bytes: %v", len(data), err)
+					return
+				}
+				tree, err := mt.NewWithPadding(CommpHashConfig, blocks, calc.nulPadding)
+				if err != nil || !bytes.Equal(tree.Root, refCommP) {
+					t.Errorf("tree commP of %d bytes: %x %v, expected %x", len(data), tree.Root, err, refCommP)
+				}
+			}(data)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, calc.ChunkCount(), expectedChunks)
+}
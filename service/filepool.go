@@ -0,0 +1,242 @@
+package metaservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	// number of files a worker of a FilePool hashes ahead of the DAG build
+	FILE_POOL_LOOKAHEAD = 4
+	// bytes of the blocks the workers of a FilePool keep for the files hashed ahead of the DAG build
+	FILE_POOL_BUFFER_SIZE = 256 << 20
+)
+
+// FilePool hashes the DAGs of files on a pool of workers, ahead of the DAG build taking them in the same order.
+// The DAG of a file only depends on its data, so the files are built the same whichever worker hashes them and
+// whenever it is done. The blocks hashed are kept while the ones of the files not taken yet fit in
+// FILE_POOL_BUFFER_SIZE, the DAG build adds them in the order they were hashed. The DAG of a file whose blocks
+// were not kept is added from its mappings, in the post-order of CheckpointFile.Nodes, which reads the file again.
+// Both give the car of a sequential build regardless of the number of workers.
+type FilePool struct {
+	index  map[string]int
+	files  []*pooledFile
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// files dispatched to the workers and not taken yet, the workers only run ahead by the capacity.
+	slots    chan struct{}
+	buffered atomic.Int64 // bytes of the blocks kept for the files not taken yet
+	lk       sync.Mutex
+	next     int // index of the next file to take
+}
+
+type pooledFile struct {
+	done chan struct{}
+	f    *CheckpointFile
+	buf  *blockBuffer
+	err  error
+}
+
+// NewFilePool hashes the files of paths with hash on workers, in the order of paths. The blocks of a file are put
+// into the blockstore given to hash, which keeps them for the DAG build while they fit.
+func NewFilePool(ctx context.Context, workers int, paths []string, hash func(ctx context.Context, path string, into bstore.Blockstore) (*CheckpointFile, error)) *FilePool {
+	return newFilePool(ctx, workers, paths, FILE_POOL_BUFFER_SIZE, hash)
+}
+
+func newFilePool(ctx context.Context, workers int, paths []string, bufferSize int64, hash func(ctx context.Context, path string, into bstore.Blockstore) (*CheckpointFile, error)) *FilePool {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p := &FilePool{
+		index:  make(map[string]int, len(paths)),
+		files:  make([]*pooledFile, len(paths)),
+		cancel: cancel,
+		slots:  make(chan struct{}, workers*FILE_POOL_LOOKAHEAD),
+	}
+	for i, path := range paths {
+		p.index[path] = i
+		p.files[i] = &pooledFile{done: make(chan struct{})}
+	}
+
+	jobs := make(chan int)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(jobs)
+		for i := range paths {
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for i := range jobs {
+				pf := p.files[i]
+				pf.buf = &blockBuffer{budget: &p.buffered, limit: bufferSize, index: make(map[cid.Cid]blocks.Block)}
+				pf.f, pf.err = hash(ctx, paths[i], pf.buf)
+				close(pf.done)
+			}
+		}()
+	}
+
+	return p
+}
+
+// File waits for the hashed DAG of the file at path and returns it with its blocks in the order they were hashed,
+// or nil blocks when they were not kept. Files must be taken in the order of the paths of the pool, another file
+// means the inputs changed since the paths were listed.
+func (p *FilePool) File(ctx context.Context, path string) (*CheckpointFile, []blocks.Block, error) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	i, ok := p.index[path]
+	if !ok {
+		return nil, nil, fmt.Errorf("file %s is not in the pool, the inputs changed", path)
+	}
+	if i != p.next {
+		return nil, nil, fmt.Errorf("file %s is taken from the pool out of order, the inputs changed", path)
+	}
+
+	pf := p.files[i]
+	select {
+	case <-pf.done:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	// free the slot of the file and its DAG.
+	<-p.slots
+	p.files[i] = nil
+	p.next++
+	blks := pf.buf.release()
+	if pf.err != nil {
+		return nil, nil, pf.err
+	}
+	// a DAG taken from a checkpoint is not hashed, its blocks are not in the buffer.
+	if _, ok := pf.buf.index[pf.f.Root]; !ok {
+		blks = nil
+	}
+	return pf.f, blks, nil
+}
+
+// Close stops hashing files and waits for the workers.
+func (p *FilePool) Close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// blockBuffer is a blockstore keeping the blocks of a file in the order they are put, as long as the blocks of the
+// files of the pool fit in the budget. Past it, its blocks are dropped and the next ones discarded.
+type blockBuffer struct {
+	budget *atomic.Int64
+	limit  int64
+
+	lk       sync.Mutex
+	blocks   []blocks.Block
+	index    map[cid.Cid]blocks.Block
+	size     int64
+	overflow bool
+}
+
+var _ bstore.Blockstore = (*blockBuffer)(nil)
+
+func (b *blockBuffer) Put(ctx context.Context, block blocks.Block) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.put(block)
+	return nil
+}
+
+func (b *blockBuffer) PutMany(ctx context.Context, blks []blocks.Block) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	for _, block := range blks {
+		b.put(block)
+	}
+	return nil
+}
+
+func (b *blockBuffer) put(block blocks.Block) {
+	if b.overflow {
+		return
+	}
+	if _, ok := b.index[block.Cid()]; ok {
+		return
+	}
+	size := int64(len(block.RawData()))
+	if b.budget.Add(size) > b.limit {
+		b.budget.Add(-b.size - size)
+		b.blocks, b.index, b.size, b.overflow = nil, nil, 0, true
+		return
+	}
+	b.blocks = append(b.blocks, block)
+	b.index[block.Cid()] = block
+	b.size += size
+}
+
+// release returns the blocks kept, and frees them from the budget.
+func (b *blockBuffer) release() []blocks.Block {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.budget.Add(-b.size)
+	b.size = 0
+	if b.overflow {
+		return nil
+	}
+	return b.blocks
+}
+
+func (b *blockBuffer) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	_, ok := b.index[c]
+	return ok, nil
+}
+
+func (b *blockBuffer) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	block, ok := b.index[c]
+	if !ok {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	return block, nil
+}
+
+func (b *blockBuffer) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	block, err := b.Get(ctx, c)
+	if err != nil {
+		return -1, err
+	}
+	return len(block.RawData()), nil
+}
+
+func (b *blockBuffer) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return errors.New("block buffer: blocks cannot be deleted")
+}
+
+func (b *blockBuffer) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	return nil, errors.New("block buffer: blocks cannot be listed")
+}
+
+func (b *blockBuffer) HashOnRead(enabled bool) {}
@@ -0,0 +1,198 @@
+package metaservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dataswap/go-metadata/libs"
+	"github.com/dataswap/go-metadata/types"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
+	"gotest.tools/assert"
+)
+
+// newTestFiles writes files of random data under a temporary directory, some of them with the same data.
+func newTestFiles(t *testing.T) (string, []string) {
+	dir := t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	var paths []string
+	var last []byte
+	for i := 0; i < 24; i++ {
+		data := make([]byte, rnd.Intn(8192))
+		rnd.Read(data)
+		if i%5 == 4 {
+			data = last
+		}
+		path := filepath.Join(dir, fmt.Sprintf("file%02d", i))
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		paths = append(paths, path)
+		last = data
+	}
+	return dir, paths
+}
+
+// buildTestFile builds the DAG of a file into dags, recording its mappings in ms.
+func buildTestFile(path string, dir string, dags ipld.DAGService, params types.DagParams, ms *MappingService) (cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer f.Close()
+	spl, err := libs.NewSplitter(f, params.Chunker, path, dir, 0)
+	if err != nil {
+		return cid.Undef, err
+	}
+	db, err := ms.GenerateHelper(&helpers.DagBuilderParams{
+		Maxlinks:   params.MaxLinks,
+		RawLeaves:  params.RawLeaves,
+		CidBuilder: params.Prefix,
+		Dagserv:    ms.GenerateDagService(dags),
+	}, spl)
+	if err != nil {
+		return cid.Undef, err
+	}
+	root, err := libs.Layout(db, params.Layout)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return root.Cid(), nil
+}
+
+// buildTestCar writes the car of a directory of the files, built one after the other without workers
+// or hashed by a FilePool of workers keeping up to bufferSize bytes of blocks, and returns it with the service
+// of its mappings.
+func buildTestCar(t *testing.T, dir string, paths []string, params types.DagParams, workers int, bufferSize int64, opts ...Option) ([]byte, *MappingService) {
+	ctx := context.Background()
+	carPath := filepath.Join(t.TempDir(), "test.car")
+	cw, err := NewCarWriter(carPath, params.Prefix)
+	assert.NilError(t, err)
+	dags := merkledag.NewDAGService(blockservice.New(cw, offline.Exchange(cw)))
+	ms := New(append([]Option{DagParams(params)}, opts...)...)
+	ms.RecordCarBlocks(cw)
+
+	var pool *FilePool
+	if workers != 0 {
+		pool = newFilePool(ctx, workers, paths, bufferSize, func(ctx context.Context, path string, into bstore.Blockstore) (*CheckpointFile, error) {
+			fms := New(DagParams(params))
+			root, err := buildTestFile(path, dir, merkledag.NewDAGService(blockservice.New(into, offline.Exchange(into))), params, fms)
+			if err != nil {
+				return nil, err
+			}
+			return &CheckpointFile{Path: path, Root: root, Mappings: fms.CheckpointMappings()}, nil
+		})
+		defer pool.Close()
+	}
+
+	d := uio.NewDirectory(ms.GenerateDagService(dags))
+	d.SetCidBuilder(params.Prefix)
+	for _, path := range paths {
+		var root cid.Cid
+		if pool == nil {
+			root, err = buildTestFile(path, dir, dags, params, ms)
+			assert.NilError(t, err)
+		} else {
+			f, blks, err := pool.File(ctx, path)
+			assert.NilError(t, err)
+			if bufferSize == FILE_POOL_BUFFER_SIZE {
+				assert.Assert(t, blks != nil, "the blocks of %s are not kept", path)
+			}
+			// the mappings are recorded first, so the blocks are placed as they are written.
+			ms.RecordCheckpointFile(f)
+			if blks != nil {
+				assert.NilError(t, cw.PutMany(ctx, blks))
+			} else {
+				assert.NilError(t, f.Nodes(dir, params, func(node ipld.Node, m *types.ChunkMapping) error {
+					return dags.Add(ctx, node)
+				}))
+			}
+			root = f.Root
+		}
+		node, err := dags.Get(ctx, root)
+		assert.NilError(t, err)
+		assert.NilError(t, d.AddChild(ctx, filepath.Base(path), node))
+
+		// the memory taken by the mappings and the offsets of the blocks is bounded by the spill limit.
+		if ms.spill != nil {
+			assert.Assert(t, len(ms.mappings) < ms.spill.limit, "%d mappings in memory", len(ms.mappings))
+			assert.Equal(t, len(ms.offsets), 0)
+			assert.Assert(t, len(cw.index.recent) < ms.spill.limit, "%d offsets in memory", len(cw.index.recent))
+			assert.Assert(t, len(cw.index.runs) <= BLOCK_INDEX_MAX_RUNS)
+		}
+	}
+	if pool != nil {
+		assert.Equal(t, pool.buffered.Load(), int64(0))
+	}
+	node, err := d.GetNode()
+	assert.NilError(t, err)
+	assert.NilError(t, ms.GenerateDagService(dags).Add(ctx, node))
+
+	assert.NilError(t, cw.Finish(node.Cid()))
+	assert.NilError(t, ms.FinishCarBlocks())
+	ms.SetCarDataRoot(node.Cid())
+	carBuf, err := os.ReadFile(carPath)
+	assert.NilError(t, err)
+	return carBuf, ms
+}
+
+func TestFilePoolDeterminism(t *testing.T) {
+	dir, paths := newTestFiles(t)
+	for _, params := range []types.DagParams{
+		{Prefix: merkledag.V1CidPrefix(), Chunker: "size-256", Layout: libs.BalancedLayout, RawLeaves: true, MaxLinks: 3},
+		{Prefix: merkledag.V0CidPrefix(), Chunker: "rabin-64-128-256", Layout: libs.TrickleLayout, RawLeaves: false, MaxLinks: 2},
+	} {
+		// The car is the one of a sequential build whatever the number of workers.
+		expected, _ := buildTestCar(t, dir, paths, params, 0, 0)
+		for _, workers := range []int{1, 2, 3, 8, 32} {
+			// the blocks of all, some or none of the files are kept.
+			for _, bufferSize := range []int64{FILE_POOL_BUFFER_SIZE, 16 << 10, 0} {
+				carBuf, _ := buildTestCar(t, dir, paths, params, workers, bufferSize)
+				assert.Assert(t, bytes.Equal(carBuf, expected), "the car of %d workers keeping %d bytes with %+v differs", workers, bufferSize, params)
+			}
+		}
+	}
+}
+
+func TestFilePoolOrder(t *testing.T) {
+	ctx := context.Background()
+	paths := []string{"a", "b", "c", "d"}
+	errHash := errors.New("hash failed")
+	pool := NewFilePool(ctx, 2, paths, func(ctx context.Context, path string, into bstore.Blockstore) (*CheckpointFile, error) {
+		if path == "c" {
+			return nil, errHash
+		}
+		return &CheckpointFile{Path: path}, nil
+	})
+	defer pool.Close()
+
+	f, _, err := pool.File(ctx, "a")
+	assert.NilError(t, err)
+	assert.Equal(t, f.Path, "a")
+
+	// Files are taken in the order of the pool.
+	_, _, err = pool.File(ctx, "c")
+	assert.ErrorContains(t, err, "out of order")
+	_, _, err = pool.File(ctx, "e")
+	assert.ErrorContains(t, err, "not in the pool")
+	_, _, err = pool.File(ctx, "a")
+	assert.ErrorContains(t, err, "out of order")
+
+	f, _, err = pool.File(ctx, "b")
+	assert.NilError(t, err)
+	assert.Equal(t, f.Path, "b")
+	_, _, err = pool.File(ctx, "c")
+	assert.Equal(t, err, errHash)
+}
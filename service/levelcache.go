@@ -0,0 +1,165 @@
+package metaservice
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	mt "github.com/txaty/go-merkletree"
+	"golang.org/x/xerrors"
+)
+
+// CacheMismatch is a subtree of a level cache which is not the one of the piece. The level is the one of the tree,
+// the leaves being at 0, the root of the piece is reported at the level above the cache.
+type CacheMismatch struct {
+	Level    int
+	Index    uint64
+	Offset   uint64 // range of the car under the subtree
+	Size     uint64
+	Cached   []byte
+	Computed []byte
+}
+
+// String describes the mismatching subtree.
+func (m *CacheMismatch) String() string {
+	return fmt.Sprintf("subtree %d at level %d, car range %d+%d: cached 0x%x, computed 0x%x", m.Index, m.Level, m.Offset, m.Size, m.Cached, m.Computed)
+}
+
+// VerifyLevelCache recomputes the layers of the level cache file from the car read from r, and the root from them.
+// It returns the first mismatching subtree, the lowest one first in the order of the car, nil when the cache and
+// the car are the ones of the piece of commP.
+func VerifyLevelCache(cacheFile string, r io.Reader, commP []byte) (*CacheMismatch, error) {
+	lc, err := mt.NewLevelCacheFromFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+
+	w := NewCommPWriter()
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	computed, err := w.LevelCache()
+	if err != nil {
+		return nil, err
+	}
+	if computed.Start != lc.Start {
+		return nil, xerrors.Errorf("the level cache starts at level %d, the one of the car at %d", lc.Start, computed.Start)
+	}
+	root, _, err := w.Sum()
+	if err != nil {
+		return nil, err
+	}
+
+	levels := lc.Level
+	if computed.Level > levels {
+		levels = computed.Level
+	}
+	for i := 0; i < levels; i++ {
+		if m := compareLevel(lc.Start+i, levelNodes(lc, i), levelNodes(computed, i)); m != nil {
+			return m, nil
+		}
+	}
+	return compareRoot(lc.Start+levels, commP, root), nil
+}
+
+// VerifyLevelCacheRoot checks every layer of the level cache file hashes to the layer above it and the top one to
+// commP, without the car. It returns the first mismatching subtree as VerifyLevelCache, nil when they all match.
+func VerifyLevelCacheRoot(cacheFile string, commP []byte) (*CacheMismatch, error) {
+	lc, err := mt.NewLevelCacheFromFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	if lc.Level == 0 {
+		return nil, xerrors.Errorf("the level cache holds no node")
+	}
+
+	for i := 1; i < lc.Level; i++ {
+		parents, err := parentNodes(lc.Start+i-1, lc.Nodes[i-1])
+		if err != nil {
+			return nil, err
+		}
+		if m := compareLevel(lc.Start+i, lc.Nodes[i], parents); m != nil {
+			return m, nil
+		}
+	}
+
+	// the top layer is hashed up to the root, it holds the two children of the root of a cache of GenCommP.
+	level, nodes := lc.Start+lc.Level-1, lc.Nodes[lc.Level-1]
+	for len(nodes) > 1 {
+		if nodes, err = parentNodes(level, nodes); err != nil {
+			return nil, err
+		}
+		level++
+	}
+	return compareRoot(level, commP, nodes[0]), nil
+}
+
+//### internal functions
+
+// levelNodes returns the nodes of the i-th layer of the level cache, none above its top layer.
+func levelNodes(lc *mt.LevelCache, i int) [][]byte {
+	if i >= lc.Level {
+		return nil
+	}
+	return lc.Nodes[i]
+}
+
+// parentNodes hashes the pairs of the nodes of a level, an odd last node with the nul node of the level.
+func parentNodes(level int, nodes [][]byte) ([][]byte, error) {
+	parents := make([][]byte, (len(nodes)+1)/2)
+	for i := range parents {
+		right := StackedNulPadding[level]
+		if 2*i+1 < len(nodes) {
+			right = nodes[2*i+1]
+		}
+		parent, err := NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), nodes[2*i]...), right...))
+		if err != nil {
+			return nil, err
+		}
+		parents[i] = parent
+	}
+	return parents, nil
+}
+
+// compareLevel returns the first mismatching node of the cached and the computed nodes of a level, the nodes past
+// the end of a level are the nul nodes padding it.
+func compareLevel(level int, cached [][]byte, computed [][]byte) *CacheMismatch {
+	n := len(cached)
+	if len(computed) > n {
+		n = len(computed)
+	}
+	for i := 0; i < n; i++ {
+		c, d := StackedNulPadding[level], StackedNulPadding[level]
+		if i < len(cached) {
+			c = cached[i]
+		}
+		if i < len(computed) {
+			d = computed[i]
+		}
+		if !bytes.Equal(c, d) {
+			return newCacheMismatch(level, uint64(i), c, d)
+		}
+	}
+	return nil
+}
+
+// compareRoot returns the mismatch of the root of the piece, nil when it is commP.
+func compareRoot(level int, commP []byte, root []byte) *CacheMismatch {
+	if bytes.Equal(commP, root) {
+		return nil
+	}
+	return newCacheMismatch(level, 0, commP, root)
+}
+
+// newCacheMismatch creates the mismatch of the subtree at level and index, with the range of the car under it.
+func newCacheMismatch(level int, index uint64, cached []byte, computed []byte) *CacheMismatch {
+	size := (uint64(1) << level) / CHUNK_NODES_NUM * SOURCE_CHUNK_SIZE
+	return &CacheMismatch{
+		Level:    level,
+		Index:    index,
+		Offset:   index * size,
+		Size:     size,
+		Cached:   cached,
+		Computed: computed,
+	}
+}
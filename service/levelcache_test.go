@@ -0,0 +1,103 @@
+package metaservice
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	mt "github.com/txaty/go-merkletree"
+	"gotest.tools/assert"
+)
+
+// corruptLevelCache stores a copy of the level cache file with the node at index of the i-th layer changed.
+func corruptLevelCache(t *testing.T, cacheFile string, i int, index int) string {
+	lc, err := mt.NewLevelCacheFromFile(cacheFile)
+	assert.NilError(t, err)
+	node := append([]byte(nil), lc.Nodes[i][index]...)
+	node[0] ^= 1
+	lc.Nodes[i][index] = node
+	path := filepath.Join(t.TempDir(), filepath.Base(cacheFile))
+	assert.NilError(t, lc.StoreToFile(path))
+	return path
+}
+
+func TestVerifyLevelCache(t *testing.T) {
+	testCar, err := os.ReadFile("../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car")
+	assert.NilError(t, err)
+	largeCar := make([]byte, 2*CAR_2MIB_CHUNK_SIZE+1000)
+	rand.New(rand.NewSource(1)).Read(largeCar)
+
+	for _, data := range [][]byte{testCar, largeCar} {
+		cacheFile, commCid := storeTestPiece(t, data)
+		commP, err := commcid.CIDToDataCommitmentV1(commCid)
+		assert.NilError(t, err)
+		start := CarCacheLayerStart(uint64(len(data)))
+		carChunkSize, _ := CarChunkParams(uint64(len(data)))
+
+		m, err := VerifyLevelCache(cacheFile, bytes.NewReader(data), commP)
+		assert.NilError(t, err)
+		assert.Assert(t, m == nil, "%v", m)
+		m, err = VerifyLevelCacheRoot(cacheFile, commP)
+		assert.NilError(t, err)
+		assert.Assert(t, m == nil, "%v", m)
+
+		// the cache of GenCommP is the same.
+		cachePath := t.TempDir()
+		rawCommP, _, err := GenCommP(*bytes.NewBuffer(data), cachePath, 0)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, rawCommP, commP)
+		m, err = VerifyLevelCache(filepath.Join(cachePath, commCid.String()+CACHE_SUFFIX), bytes.NewReader(data), commP)
+		assert.NilError(t, err)
+		assert.Assert(t, m == nil, "%v", m)
+
+		// a changed byte of the car is in the first mismatching subtree.
+		changed := append([]byte(nil), data...)
+		offset := uint64(len(data)) - carChunkSize/2
+		changed[offset] ^= 1
+		m, err = VerifyLevelCache(cacheFile, bytes.NewReader(changed), commP)
+		assert.NilError(t, err)
+		assert.Assert(t, m != nil)
+		assert.Equal(t, m.Level, start)
+		assert.Equal(t, m.Index, offset/carChunkSize)
+		assert.Assert(t, m.Offset <= offset && offset < m.Offset+m.Size)
+
+		// a changed node of the start layer is found with the car, its parent without.
+		corrupted := corruptLevelCache(t, cacheFile, 0, 3)
+		m, err = VerifyLevelCache(corrupted, bytes.NewReader(data), commP)
+		assert.NilError(t, err)
+		assert.Equal(t, m.Level, start)
+		assert.Equal(t, m.Index, uint64(3))
+		m, err = VerifyLevelCacheRoot(corrupted, commP)
+		assert.NilError(t, err)
+		assert.Equal(t, m.Level, start+1)
+		assert.Equal(t, m.Index, uint64(1))
+
+		corrupted = corruptLevelCache(t, cacheFile, 1, 1)
+		for _, verify := range []func() (*CacheMismatch, error){
+			func() (*CacheMismatch, error) { return VerifyLevelCache(corrupted, bytes.NewReader(data), commP) },
+			func() (*CacheMismatch, error) { return VerifyLevelCacheRoot(corrupted, commP) },
+		} {
+			m, err := verify()
+			assert.NilError(t, err)
+			assert.Equal(t, m.Level, start+1)
+			assert.Equal(t, m.Index, uint64(1))
+		}
+
+		// the cache of another piece does not match its root.
+		other := StackedNulPadding[2]
+		depth := bits.TrailingZeros64(PaddedPieceSize(uint64(len(data))) / NODE_SIZE)
+		m, err = VerifyLevelCacheRoot(cacheFile, other)
+		assert.NilError(t, err)
+		assert.Equal(t, m.Level, depth)
+		assert.DeepEqual(t, m.Cached, other)
+		assert.DeepEqual(t, m.Computed, commP)
+		m, err = VerifyLevelCache(cacheFile, bytes.NewReader(data), other)
+		assert.NilError(t, err)
+		assert.Equal(t, m.Level, depth)
+		assert.DeepEqual(t, m.Computed, commP)
+	}
+}
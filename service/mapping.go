@@ -1,19 +1,22 @@
 package metaservice
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/dataswap/go-metadata/libs"
 	"github.com/dataswap/go-metadata/types"
 	"github.com/dataswap/go-metadata/utils"
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-merkledag"
 	helpers "github.com/ipfs/go-unixfs/importer/helpers"
 	"github.com/ipld/go-car/util"
 
@@ -29,6 +32,8 @@ const (
 	METAS_PATH          = "metas"
 	MAPPINGS_PATH       = "mappings"
 	MAPPING_FILE_SUFFIX = ".json"
+	// version of the mapping schema, mapping files of version 1 and above record the DAG parameters.
+	MAPPING_VERSION = 1
 )
 
 // MappingService generates the mapping relationship from the source file to the car file.
@@ -36,32 +41,37 @@ type MappingService struct {
 	opts         *Options
 	mappings     map[cid.Cid]*types.ChunkMapping // chunks
 	chunkRawSize map[cid.Cid]uint64              // chunks raw size
-	lk           sync.Mutex
+	// mappings sorted by DstOffset, nil when it has to be rebuilt after the mappings changed.
+	sorted []*types.ChunkMapping
+	lk     sync.Mutex
 
 	dataRoot cid.Cid
+	// set when the mappings are loaded from a binary mapping file, they are then read from it on demand.
+	file *mappingFile
+
+	// set by RecordCarBlocks, the car the offsets of the blocks are recorded from while it is written.
+	car       *CarWriter
+	offsets   map[cid.Cid]CarBlock  // blocks written before their mapping is inserted
+	placed    []*types.ChunkMapping // mappings given their offset since the last spill
+	blockErrs struct{ duplicate, resized carBlockErrors }
+	// set by the SpillMappings option, the mappings spilled to the disk and the first error spilling them.
+	spill    *mappingSpill
+	spillErr error
 }
 
 func New(opts ...Option) *MappingService {
 	options := newOptions(opts...)
-	return &MappingService{
+	ms := &MappingService{
 		opts:         options,
 		dataRoot:     cid.Undef,
 		mappings:     make(map[cid.Cid]*types.ChunkMapping, 0),
 		chunkRawSize: make(map[cid.Cid]uint64, 0),
+		offsets:      make(map[cid.Cid]CarBlock, 0),
 	}
-}
-
-// Singleton pattern for MappingService, used for data sampling restoration, proof generation, and verification.
-var (
-	instance *MappingService
-	once     sync.Once
-)
-
-func MappingServiceInstance(opts ...Option) *MappingService {
-	once.Do(func() {
-		instance = New(opts...)
-	})
-	return instance
+	if options.spillLimit > 0 {
+		ms.spill = &mappingSpill{parent: options.spillPath, limit: options.spillLimit}
+	}
+	return ms
 }
 
 // Set the DAG data root for the current CAR file.
@@ -69,6 +79,21 @@ func (ms *MappingService) SetCarDataRoot(root cid.Cid) {
 	ms.dataRoot = root
 }
 
+// Get the DAG data root of the current CAR file.
+func (ms *MappingService) DataRoot() cid.Cid {
+	return ms.dataRoot
+}
+
+// Get the parameters the DAG is built with.
+func (ms *MappingService) DagParams() types.DagParams {
+	return ms.opts.dagParams
+}
+
+// Get the CID builder of the DAG nodes.
+func (ms *MappingService) CidBuilder() cid.Builder {
+	return ms.opts.dagParams.Prefix
+}
+
 // Get the Data_DataType of a node.
 func (ms *MappingService) getNodeType(node ipld.Node) (pb.Data_DataType, error) {
 	switch tnode := node.(type) {
@@ -85,6 +110,8 @@ func (ms *MappingService) getNodeType(node ipld.Node) (pb.Data_DataType, error)
 		}
 	case *dag.ProtoNode:
 		return ms.getProtoNodeType(tnode)
+	case *dag.RawNode:
+		return pb.Data_Raw, nil
 	default:
 		return 0xff, unixfs.ErrUnrecognizedType
 	}
@@ -119,6 +146,12 @@ func (ms *MappingService) nodeAction(node ipld.Node) *types.ChunkMapping {
 	} else {
 		fmt.Printf("get node type failed:%s\n", err.Error())
 	}
+
+	// Directory nodes carry entry names and, for HAMT shards, a bitfield that cannot be derived from the links,
+	// so their unixfs data is kept in the mapping.
+	if pn, ok := node.(*dag.ProtoNode); ok && (cm.NodeType == pb.Data_Directory || cm.NodeType == pb.Data_HAMTShard) {
+		cm.Data = pn.Data()
+	}
 	return &cm
 }
 
@@ -149,99 +182,417 @@ func (ms *MappingService) helperAction(node ipld.Node, srcPath string, offset ui
 	ms.insertMapping(cm.Cid, cm, uint64(len(node.RawData())))
 }
 
-// Wrapping the io.Writer interface to implement mapping recording for writing CAR files.
-func (ms *MappingService) GenerateCarWriter(w io.Writer, path string, call bool) io.Writer {
-	if !call {
-		return w
+func (ms *MappingService) insertMapping(c cid.Cid, cm *types.ChunkMapping, rawSize uint64) error {
+	if into := ms.opts.recordInto; into != nil {
+		// the offset the car gives the mapping is not the one of ms.
+		forwarded := *cm
+		into.insertMapping(c, &forwarded, rawSize)
 	}
-	writer := libs.WrappedWriter(w, path, ms.carWriteAfterAction, libs.DefaultWriteBeforeAction)
-	return writer
-}
 
-// This callback function is invoked after each node is written to the CAR file,
-// recording the offset and size of the written data in the CAR file.
-func (ms *MappingService) carWriteAfterAction(dstpath string, buf []byte, offset uint64) {
-	// Mapping file updates are only executed when data can be parsed as a node during the writing process.
-	if c, err := cid.Parse(buf); err == nil {
-		if _, ok := ms.mappings[c]; !ok {
-			fmt.Printf("meta cid: %s is not exist\n", c.String())
-			return
-		}
-		if err := ms.updateMapping(c, offset); err != nil {
-			fmt.Printf("update meta failed:%s\n", err.Error())
-		}
+	// Checked without holding ms.lk, the car reports its blocks to ms while it holds its own lock.
+	ms.lk.Lock()
+	car := ms.car
+	ms.lk.Unlock()
+	var written bool
+	if car != nil {
+		written, _ = car.Has(context.TODO(), c)
 	}
-}
 
-func (ms *MappingService) insertMapping(c cid.Cid, cm *types.ChunkMapping, rawSize uint64) error {
 	ms.lk.Lock()
 	defer ms.lk.Unlock()
-	if _, ok := ms.mappings[c]; ok {
+	block, pending := ms.offsets[c]
+	// A block of the car whose mapping is not in memory any more had its mapping spilled.
+	if _, ok := ms.mappings[c]; ok || (written && !pending) {
 		return fmt.Errorf("meta srcpath:%s offset: %d size: %d cid: %s exist", cm.SrcPath, cm.SrcOffset, cm.Size, c.String())
 	}
 	ms.mappings[c] = cm
 	ms.chunkRawSize[c] = rawSize
+	ms.sorted = nil
+	if pending {
+		delete(ms.offsets, c)
+		ms.place(cm, block)
+	}
 	return nil
 }
 
-func (ms *MappingService) updateMapping(c cid.Cid, offset uint64) error {
+// Recording the offsets of the blocks in the CAR file as cw writes them, a block written before its mapping is
+// inserted gets its offset when it is. FinishCarBlocks checks the offsets once the CAR is finished.
+// When the mappings are spilled, the car spills the offsets of its blocks in the same directory.
+func (ms *MappingService) RecordCarBlocks(cw *CarWriter) {
+	ms.lk.Lock()
+	ms.car = cw
+	ms.lk.Unlock()
+	if ms.spill != nil {
+		cw.spillIndex(ms.spill.parent, ms.spill.limit)
+	}
+	cw.OnBlock(ms.RecordCarBlock)
+}
+
+// Recording the offset of a block written to the CAR file.
+func (ms *MappingService) RecordCarBlock(block CarBlock) {
 	ms.lk.Lock()
 	defer ms.lk.Unlock()
 
-	// Associating mapping information between the source data and the data in the CAR file based on the node CID.
-	if _, ok := ms.mappings[c]; !ok {
-		return fmt.Errorf("meta cid: %s is not exist", c.String())
+	m, ok := ms.mappings[block.Cid]
+	if !ok {
+		if _, ok := ms.offsets[block.Cid]; ok {
+			ms.blockErrs.duplicate.add(block.Cid, block.Offset)
+			return
+		}
+		ms.offsets[block.Cid] = block
+		return
+	}
+	if m.DstOffset != 0 {
+		ms.blockErrs.duplicate.add(block.Cid, block.Offset)
+		return
 	}
+	ms.place(m, block)
+}
 
-	// Calculating the starting position of a node within the CAR file.
-	if rs, ok := ms.chunkRawSize[c]; ok {
-		sum := rs + uint64(len(c.Bytes()))
-		buf := make([]byte, 8)
-		n := binary.PutUvarint(buf, sum)
-		offset = offset - uint64(n)
+// place gives the mapping the offset of its block, spilling the placed mappings once there are enough of them.
+// The caller must hold ms.lk.
+func (ms *MappingService) place(m *types.ChunkMapping, block CarBlock) {
+	if m.ChunkSize != block.Size {
+		ms.blockErrs.resized.add(block.Cid, block.Offset)
 	}
-	ms.mappings[c].DstOffset = offset
+	m.DstOffset = block.Offset
+	ms.sorted = nil
 
+	if ms.spill == nil || ms.spillErr != nil {
+		return
+	}
+	ms.placed = append(ms.placed, m)
+	if len(ms.placed) < ms.spill.limit {
+		return
+	}
+	if err := ms.spill.writeRun(ms.placed); err != nil {
+		ms.spillErr = fmt.Errorf("failed to spill the mappings: %w", err)
+		return
+	}
+	for _, m := range ms.placed {
+		delete(ms.mappings, m.Cid)
+		delete(ms.chunkRawSize, m.Cid)
+	}
+	ms.placed = nil
+}
+
+// Checking the offsets recorded from the CAR file once it is finished. Every block must have had a mapping of
+// its size and every mapping a single block, otherwise the error summarizes the mismatches.
+func (ms *MappingService) FinishCarBlocks() error {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	var shift int64
+	if ms.car != nil {
+		shift = ms.car.Shift()
+	}
+	if ms.spillErr != nil {
+		return ms.spillErr
+	}
+
+	var missing carBlockErrors
+	for c, m := range ms.mappings {
+		if m.DstOffset != 0 {
+			m.DstOffset = uint64(int64(m.DstOffset) + shift)
+			continue
+		}
+		// the mapping of a block whose first mapping was spilled.
+		if ms.car != nil {
+			if written, _ := ms.car.Has(context.TODO(), c); written {
+				delete(ms.mappings, c)
+				delete(ms.chunkRawSize, c)
+				continue
+			}
+		}
+		missing.add(c, 0)
+	}
+	var unmapped carBlockErrors
+	for c, block := range ms.offsets {
+		unmapped.add(c, block.Offset)
+	}
+	if ms.spill != nil {
+		ms.spill.shift = shift
+	}
+	ms.placed = nil
+	ms.sorted = nil
+
+	var summary []string
+	summary = ms.blockErrs.duplicate.summary(summary, "duplicate blocks")
+	summary = unmapped.summary(summary, "blocks without mapping")
+	summary = ms.blockErrs.resized.summary(summary, "blocks of another size than their mapping")
+	summary = missing.summary(summary, "mappings without block")
+	if len(summary) != 0 {
+		return fmt.Errorf("the car blocks do not match the mappings: %s", strings.Join(summary, ", "))
+	}
 	return nil
 }
 
+// Removing the mappings spilled to the disk, once they are saved, and the offsets spilled by the car.
+func (ms *MappingService) Close() error {
+	ms.lk.Lock()
+	car := ms.car
+	ms.lk.Unlock()
+	// the car reports its blocks to ms while it holds its own lock.
+	if car != nil {
+		if err := car.removeIndex(); err != nil {
+			return err
+		}
+	}
+
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	if ms.spill == nil {
+		return nil
+	}
+	return ms.spill.remove()
+}
+
+// number of mismatching blocks listed in the summary of FinishCarBlocks
+const CAR_BLOCK_ERRORS_LISTED = 3
+
+// carBlockErrors counts the blocks of a mismatch and keeps the first ones.
+type carBlockErrors struct {
+	count  int
+	listed []string
+}
+
+func (e *carBlockErrors) add(c cid.Cid, offset uint64) {
+	if e.count < CAR_BLOCK_ERRORS_LISTED {
+		if offset != 0 {
+			e.listed = append(e.listed, fmt.Sprintf("%s at %d", c, offset))
+		} else {
+			e.listed = append(e.listed, c.String())
+		}
+	}
+	e.count++
+}
+
+func (e *carBlockErrors) summary(summary []string, what string) []string {
+	if e.count == 0 {
+		return summary
+	}
+	s := fmt.Sprintf("%s: %d (%s", what, e.count, strings.Join(e.listed, ", "))
+	if e.count > len(e.listed) {
+		s += ", ..."
+	}
+	return append(summary, s+")")
+}
+
 // Saving the cached mapping information to a file.
+// The mappings are written one after the other, merged with the mappings spilled to the disk.
 func (ms *MappingService) SaveMetaMappings(path string, name string) error {
 	os.MkdirAll(path, 0o775)
 
+	params := ms.opts.dagParams
 	m := &types.Mapping{
+		Version:  MAPPING_VERSION,
 		DataRoot: ms.dataRoot,
-		Mappings: make([]*types.ChunkMapping, 0),
+		Params:   &params,
+		Mappings: []*types.ChunkMapping{},
 	}
-	ms.lk.Lock()
-	defer ms.lk.Unlock()
-	for _, v := range ms.mappings {
-		m.Mappings = append(m.Mappings, v)
+
+	metaPath := filepath.Join(path, name)
+	return writeMappingJson(metaPath, m, ms.walkSortedMappings)
+}
+
+// writeMappingJson writes the mapping file of m with the mappings walked, as utils.WriteJson with a tab indent
+// writes it with all the mappings in m.
+func writeMappingJson(path string, m *types.Mapping, walk func(fn func(cm *types.ChunkMapping) error) error) error {
+	header, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	// the empty mappings are the last field.
+	end := []byte("[]\n}")
+	if !bytes.HasSuffix(header, end) {
+		return fmt.Errorf("unexpected mapping file header")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	sort.Slice(m.Mappings, func(i int, j int) bool {
-		return m.Mappings[i].DstOffset < m.Mappings[j].DstOffset
+	w := bufio.NewWriter(f)
+	w.Write(header[:len(header)-len(end)])
+	w.WriteByte('[')
+	var count int
+	err = walk(func(cm *types.ChunkMapping) error {
+		data, err := json.MarshalIndent(cm, "\t\t", "\t")
+		if err != nil {
+			return err
+		}
+		if count != 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString("\n\t\t")
+		_, err = w.Write(data)
+		count++
+		return err
 	})
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		w.WriteString("\n\t")
+	}
+	w.WriteString("]\n}")
 
-	metaPath := filepath.Join(path, name)
-	return utils.WriteJson(metaPath, "\t", m)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Saving the cached mapping information to a file in the binary mapping format.
+// Intermediate file nodes get their unixfs data recorded, so any range of records can be used on its own.
+func (ms *MappingService) SaveBinaryMetaMappings(path string, name string) error {
+	os.MkdirAll(path, 0o775)
+
+	// the data of intermediate file nodes is rebuilt from the mappings of their children, which must be in memory.
+	if ms.spill != nil && len(ms.spill.runs) != 0 {
+		return fmt.Errorf("mappings spilled to the disk are only saved in the json format")
+	}
+	mappings, err := ms.sortedMappings()
+	if err != nil {
+		return err
+	}
+
+	for i, m := range mappings {
+		if m.SrcPath != "" || len(m.Data) != 0 || len(m.Links) == 0 {
+			continue
+		}
+		node, err := ms.GenerateNodeWithoutData(m, m.Cid.Prefix())
+		if err != nil {
+			return err
+		}
+		pn, ok := node.(*dag.ProtoNode)
+		if !ok || !pn.Cid().Equals(m.Cid) {
+			return fmt.Errorf("failed to rebuild node data, cid:%s", m.Cid.String())
+		}
+		cm := *m
+		cm.Data = pn.Data()
+		mappings[i] = &cm
+	}
+
+	params := ms.opts.dagParams
+	return writeMappingFile(filepath.Join(path, name), ms.dataRoot, MAPPING_VERSION, &params, mappings)
 }
 
 // Loading mapping information from a file into the MappingService cache.
+// Binary mapping files are not loaded into the cache, only their index is read.
 func (ms *MappingService) LoadMetaMappings(path string) error {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	ms.mappings = make(map[cid.Cid]*types.ChunkMapping, 0)
+	ms.sorted = nil
+	ms.file = nil
+
+	if IsBinaryMappingFile(path) {
+		mf, err := openMappingFile(path)
+		if err != nil {
+			return err
+		}
+		if err := ms.loadDagParams(mf.version, mf.params); err != nil {
+			return err
+		}
+		ms.file = mf
+		ms.dataRoot = mf.dataRoot
+		return nil
+	}
+
 	var m types.Mapping
 	err := utils.ReadJson(path, &m)
 	if err != nil {
 		return err
 	}
-	ms.mappings = make(map[cid.Cid]*types.ChunkMapping, 0)
+	if err := ms.loadDagParams(m.Version, m.Params); err != nil {
+		return err
+	}
 	ms.dataRoot = m.DataRoot
 	for _, v := range m.Mappings {
 		ms.mappings[v.Cid] = v
 	}
+	ms.sortedIndex()
+	return nil
+}
+
+// The DAG is rebuilt with the parameters recorded in the mapping file, the options are only used for
+// mapping files of version 0, which do not record them.
+func (ms *MappingService) loadDagParams(version uint64, params *types.DagParams) error {
+	if version > MAPPING_VERSION {
+		return fmt.Errorf("unsupported mapping version %d, the latest supported is %d", version, MAPPING_VERSION)
+	}
+	if version == 0 {
+		return nil
+	}
+	if params == nil {
+		return fmt.Errorf("mapping file of version %d has no DAG parameters", version)
+	}
+	ms.opts.dagParams = *params
 	return nil
 }
 
+// All the mappings sorted by their offset in the car.
+func (ms *MappingService) sortedMappings() ([]*types.ChunkMapping, error) {
+	if ms.file != nil {
+		return ms.file.all()
+	}
+
+	var mappings []*types.ChunkMapping
+	err := ms.walkSortedMappings(func(m *types.ChunkMapping) error {
+		mappings = append(mappings, m)
+		return nil
+	})
+	return mappings, err
+}
+
+// walkSortedMappings calls fn with all the mappings sorted by their offset in the car, merging the spilled ones.
+// fn must not call the methods of ms.
+func (ms *MappingService) walkSortedMappings(fn func(m *types.ChunkMapping) error) error {
+	if ms.file != nil {
+		var err error
+		if scanErr := ms.file.scan(ms.file.start, func(m *types.ChunkMapping) bool {
+			err = fn(m)
+			return err == nil
+		}); scanErr != nil {
+			return scanErr
+		}
+		return err
+	}
+
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	if ms.spill == nil {
+		for _, m := range ms.sortedIndex() {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ms.spill.merge(ms.sortedIndex(), fn)
+}
+
+// sortedIndex returns the mappings sorted by DstOffset, rebuilding the index if the mappings changed.
+// The caller must hold ms.lk and must not modify the returned slice.
+func (ms *MappingService) sortedIndex() []*types.ChunkMapping {
+	if ms.sorted != nil {
+		return ms.sorted
+	}
+
+	mappings := make([]*types.ChunkMapping, 0, len(ms.mappings))
+	for _, v := range ms.mappings {
+		mappings = append(mappings, v)
+	}
+
+	sort.Slice(mappings, func(i int, j int) bool {
+		return mappings[i].DstOffset < mappings[j].DstOffset
+	})
+	ms.sorted = mappings
+	return ms.sorted
+}
+
 // Verifying if the mapping information represents a continuous segment of data within the CAR file.
 func (ms *MappingService) verifyMappingsContinuity(mappings []*types.ChunkMapping) error {
 	var nextStart uint64
@@ -259,16 +610,12 @@ func (ms *MappingService) verifyMappingsContinuity(mappings []*types.ChunkMappin
 
 // Getting all mapping information from the MappingService cache.
 func (ms *MappingService) GetAllChunkMappings() ([]*types.ChunkMapping, error) {
-	var mappings []*types.ChunkMapping
-
-	for _, v := range ms.mappings {
-		mappings = append(mappings, v)
+	mappings, err := ms.sortedMappings()
+	if err != nil {
+		return nil, err
 	}
 
-	sort.Slice(mappings, func(i, j int) bool {
-		return mappings[i].DstOffset < mappings[j].DstOffset
-	})
-	err := ms.verifyMappingsContinuity(mappings)
+	err = ms.verifyMappingsContinuity(mappings)
 	return mappings, err
 }
 
@@ -278,19 +625,28 @@ func (ms *MappingService) GetChunkMappings(dstOffset uint64, dstSize uint64) ([]
 	chunkEnd := dstOffset + dstSize
 	var mappings []*types.ChunkMapping
 
-	for _, v := range ms.mappings {
-		start, end := v.ChunkRangeInCar()
-		if chunkStart <= start && chunkEnd >= start && chunkEnd <= end ||
-			chunkStart >= start && chunkStart <= end && chunkEnd >= end ||
-			chunkStart <= start && chunkEnd >= end ||
-			chunkStart >= start && chunkEnd <= end {
-			mappings = append(mappings, v)
+	// Binary mapping files are sorted by offset, only the overlapping records are read.
+	if ms.file != nil {
+		mappings, err := ms.file.chunkMappings(chunkStart, chunkEnd)
+		if err != nil {
+			return nil, err
 		}
+		return mappings, ms.verifyMappingsContinuity(mappings)
 	}
 
-	sort.Slice(mappings, func(i, j int) bool {
-		return mappings[i].DstOffset < mappings[j].DstOffset
+	ms.lk.Lock()
+	index := ms.sortedIndex()
+	ms.lk.Unlock()
+
+	// The blocks of a car do not overlap, so their ends are sorted as well. The ranges are inclusive,
+	// a block ending at chunkStart or starting at chunkEnd overlaps the chunk.
+	i := sort.Search(len(index), func(i int) bool {
+		_, end := index[i].ChunkRangeInCar()
+		return end >= chunkStart
 	})
+	for ; i < len(index) && index[i].DstOffset <= chunkEnd; i++ {
+		mappings = append(mappings, index[i])
+	}
 
 	err := ms.verifyMappingsContinuity(mappings)
 
@@ -301,7 +657,8 @@ func (ms *MappingService) GetChunkMappings(dstOffset uint64, dstSize uint64) ([]
 // and data obtained from the source file.
 // For example, generating a 2MB data fragment for which a consistency proof needs to be challenged.
 func (ms *MappingService) GenerateChunksFromMappings(path string, srcParent string, mappings []*types.ChunkMapping) error {
-	cidBuilder, err := merkledag.PrefixForCidVersion(1)
+	cidBuilder := ms.CidBuilder()
+	reader, err := ms.sourceReader(srcParent)
 	if err != nil {
 		return err
 	}
@@ -316,24 +673,9 @@ func (ms *MappingService) GenerateChunksFromMappings(path string, srcParent stri
 	pack.WriteCarHeader(file, ms.dataRoot)
 
 	for _, m := range mappings {
-		var err error
-		var node ipld.Node
-		if m.SrcPath != "" {
-			// When SrcPath is not empty, data needs to be obtained from the source file to construct the current node.
-			node, err = ms.GenerateNodeFromSource(path, srcParent, m, cidBuilder)
-			if err != nil {
-				return err
-			}
-		} else {
-			// When SrcPath is empty, construct the node directly from the mapping information.
-			node, err = ms.GenerateNodeWithoutData(m, cidBuilder)
-			if err != nil {
-				return err
-			}
-		}
-		// If the constructed node does not match the node CID recorded in the mapping information, it indicates that the newly built node is incorrect.
-		if node.Cid().String() != m.Cid.String() {
-			return fmt.Errorf("The generated CID for the node is not consistent with the metadata record.")
+		node, err := ms.generateNode(reader, m, cidBuilder)
+		if err != nil {
+			return err
 		}
 
 		// Writing a node to the CAR fragment file at a specified offset based on the mapping information.
@@ -347,8 +689,61 @@ func (ms *MappingService) GenerateChunksFromMappings(path string, srcParent stri
 	return nil
 }
 
+// Size of the CAR file, the end of its last block.
+func (ms *MappingService) CarSize() (uint64, error) {
+	if ms.file != nil {
+		last, err := ms.file.last()
+		if err != nil || last == nil {
+			return 0, err
+		}
+		_, end := last.ChunkRangeInCar()
+		return end, nil
+	}
+
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	index := ms.sortedIndex()
+	if len(index) == 0 {
+		return 0, nil
+	}
+	_, end := index[len(index)-1].ChunkRangeInCar()
+	return end, nil
+}
+
+// Node construction from the source data or the mapping information alone, checked against the recorded CID.
+func (ms *MappingService) generateNode(reader SourceReader, m *types.ChunkMapping, cidBuilder cid.Builder) (ipld.Node, error) {
+	var err error
+	var node ipld.Node
+	if m.SrcPath != "" {
+		// When SrcPath is not empty, data needs to be obtained from the source file to construct the current node.
+		node, err = ms.generateNodeFromReader(reader, m, cidBuilder)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// When SrcPath is empty, construct the node directly from the mapping information.
+		node, err = ms.GenerateNodeWithoutData(m, cidBuilder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// If the constructed node does not match the node CID recorded in the mapping information, it indicates that the newly built node is incorrect.
+	if node.Cid().String() != m.Cid.String() {
+		return nil, fmt.Errorf("The generated CID for the node is not consistent with the metadata record.")
+	}
+	return node, nil
+}
+
 // Node construction without involving the source data.
 func (ms *MappingService) GenerateNodeWithoutData(m *types.ChunkMapping, cidBuilder cid.Builder) (ipld.Node, error) {
+	if len(m.Data) != 0 || m.NodeType == pb.Data_Directory || m.NodeType == pb.Data_HAMTShard {
+		return ms.generateNodeFromData(m, cidBuilder)
+	}
+	// The raw leaf of an empty file, which has no source data.
+	if m.Cid.Type() == cid.Raw {
+		return helpers.NewLeafNode(nil, m.NodeType, cidBuilder, true)
+	}
+
 	fsNode := helpers.NewFSNodeOverDag(m.NodeType, cidBuilder)
 	for _, link := range m.Links {
 		cm, ok := ms.mappings[link.Cid]
@@ -357,7 +752,11 @@ func (ms *MappingService) GenerateNodeWithoutData(m *types.ChunkMapping, cidBuil
 		}
 		var blockSize uint64
 		if m.NodeType == pb.Data_File {
-			blockSize = cm.Size
+			size, err := ms.fileSize(cm)
+			if err != nil {
+				return nil, err
+			}
+			blockSize = size
 		} else {
 			blockSize = cm.BlockSize
 		}
@@ -373,11 +772,65 @@ func (ms *MappingService) GenerateNodeWithoutData(m *types.ChunkMapping, cidBuil
 	return node, nil
 }
 
+// The size of the file data below a node, the data size of a leaf or the sum over the leaves of an intermediate
+// file node, which deep balanced and trickle DAGs link to.
+func (ms *MappingService) fileSize(m *types.ChunkMapping) (uint64, error) {
+	if m.SrcPath != "" || len(m.Links) == 0 {
+		return m.Size, nil
+	}
+	var size uint64
+	for _, link := range m.Links {
+		cm, ok := ms.mappings[link.Cid]
+		if !ok {
+			return 0, fmt.Errorf("cant find meta ,cid:%s", link.Cid.String())
+		}
+		s, err := ms.fileSize(cm)
+		if err != nil {
+			return 0, err
+		}
+		size += s
+	}
+	return size, nil
+}
+
+// Node construction from the recorded unixfs data and named links, used for directories, HAMT shards
+// and the intermediate file nodes of binary mapping files.
+func (ms *MappingService) generateNodeFromData(m *types.ChunkMapping, cidBuilder cid.Builder) (ipld.Node, error) {
+	if len(m.Data) == 0 {
+		return nil, fmt.Errorf("directory meta has no data, cid:%s", m.Cid.String())
+	}
+	node := dag.NodeWithData(m.Data)
+	if err := node.SetCidBuilder(cidBuilder); err != nil {
+		return nil, err
+	}
+	for _, link := range m.Links {
+		if err := node.AddRawLink(link.Name, link); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
 // Node construction involving the source data.
 func (ms *MappingService) GenerateNodeFromSource(path string, srcParent string, m *types.ChunkMapping, cidBuilder cid.Builder) (ipld.Node, error) {
-	// Getting the source file path.
-	srcPath := filepath.Join(srcParent, m.SrcPath)
-	sfile, err := os.Open(srcPath)
+	reader, err := ms.sourceReader(srcParent)
+	if err != nil {
+		return nil, err
+	}
+	return ms.generateNodeFromReader(reader, m, cidBuilder)
+}
+
+// The reader of the source data, set by the Source option or else created from srcParent.
+func (ms *MappingService) sourceReader(srcParent string) (SourceReader, error) {
+	if ms.opts.sourceReader != nil {
+		return ms.opts.sourceReader, nil
+	}
+	return NewSourceReader(srcParent)
+}
+
+// Node construction from the source data read through reader.
+func (ms *MappingService) generateNodeFromReader(reader SourceReader, m *types.ChunkMapping, cidBuilder cid.Builder) (ipld.Node, error) {
+	sfile, err := reader.Open(m.SrcPath)
 	if err != nil {
 		return nil, err
 	}
@@ -385,18 +838,17 @@ func (ms *MappingService) GenerateNodeFromSource(path string, srcParent string,
 	data := make([]byte, m.Size)
 
 	// Fetching smaller data fragments only from the source file at a specified offset.
-	// This can be further adapted to work with cloud storage systems like AWS.
 	if _, err := sfile.ReadAt(data, int64(m.SrcOffset)); err != nil {
 		return nil, err
 	}
 
-	node, err := helpers.NewLeafNode(data, m.NodeType, cidBuilder, ms.opts.rawLeaves)
+	node, err := helpers.NewLeafNode(data, m.NodeType, cidBuilder, ms.opts.dagParams.RawLeaves)
 	if err != nil {
 		return nil, err
 	}
 
 	node = helpers.ProcessFileStore(node, m.Size)
-	if _, ok := ms.mappings[node.Cid()]; !ok {
+	if !node.Cid().Equals(m.Cid) {
 		return nil, fmt.Errorf("generate new node from source failed,new cid:%s", node.Cid().String())
 	}
 
@@ -414,55 +866,38 @@ func (ms *MappingService) SourceParentPath() string {
 }
 
 // Use this function to generate data fragments of the CAR file at challenge points when creating challenge proofs.
-func GetChallengeChunk(commCid cid.Cid, offset uint64, size uint64) ([]byte, error) {
-	ms := MappingServiceInstance()
-	metaPath := filepath.Join(ms.MetaPath(), commCid.String()+MAPPING_FILE_SUFFIX)
-	if !utils.PathExists(metaPath) {
-		return nil, fmt.Errorf("cant find meta file:%s", metaPath)
-	}
-
-	// Loading mapping files.
-	ms.LoadMetaMappings(metaPath)
-
-	// Getting mapping information for challenge points.
-	mappings, err := ms.GetChunkMappings(offset, size)
+// The mapping file of the piece is loaded into ms.
+func (ms *MappingService) GetChallengeChunk(commCid cid.Cid, offset uint64, size uint64) ([]byte, error) {
+	vc, err := ms.PieceVirtualCar(commCid)
 	if err != nil {
 		return nil, err
 	}
-
-	tempDir, err := os.MkdirTemp("", "")
-	if err != nil {
-		return nil, err
-	}
-	defer os.RemoveAll(tempDir)
-
-	targetPath := filepath.Join(tempDir, commCid.String()+".car")
-
-	// Generating temporary data fragment files.
-	if err := ms.GenerateChunksFromMappings(targetPath, ms.SourceParentPath(), mappings); err != nil {
+	buf := make([]byte, size)
+	n, err := vc.ReadAt(buf, int64(offset))
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
 
-	file, err := os.Open(targetPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+	return buf[:n], nil
+}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, err
+// PieceVirtualCar loads the mapping file of the piece commCid under MetaPath into ms and creates the VirtualCar
+// rebuilding its car from the source data.
+func (ms *MappingService) PieceVirtualCar(commCid cid.Cid) (*VirtualCar, error) {
+	// Binary mapping files are preferred, they are not loaded as a whole.
+	metaPath := filepath.Join(ms.MetaPath(), commCid.String()+MAPPING_BINARY_FILE_SUFFIX)
+	if !utils.PathExists(metaPath) {
+		metaPath = filepath.Join(ms.MetaPath(), commCid.String()+MAPPING_FILE_SUFFIX)
 	}
-	fileSize := fileInfo.Size() - int64(offset)
-	if fileSize < int64(size) {
-		size = uint64(fileSize)
+	if !utils.PathExists(metaPath) {
+		return nil, fmt.Errorf("cant find meta file:%s", metaPath)
 	}
 
-	// Get fragment file cache from a specific offset in the temporary file.
-	buf := make([]byte, size)
-	if _, err := file.ReadAt(buf, int64(offset)); err != nil {
+	// Loading mapping files.
+	if err := ms.LoadMetaMappings(metaPath); err != nil {
 		return nil, err
 	}
 
-	return buf, nil
+	// Rebuilding the ranges of the CAR file from the mappings overlapping them.
+	return NewVirtualCar(ms, ms.SourceParentPath())
 }
@@ -1,15 +1,26 @@
 package metaservice
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/dataswap/go-metadata/libs"
 	"github.com/dataswap/go-metadata/types"
+	"github.com/dataswap/go-metadata/utils"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/hamt"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	mh "github.com/multiformats/go-multihash"
 	"gotest.tools/assert"
 )
 
@@ -102,7 +113,7 @@ func TestMappingService_GetAllChunkMappings(t *testing.T) {
 	}
 }
 
-func TestMappingService_UpdateMapping(t *testing.T) {
+func TestMappingService_RecordCarBlocks(t *testing.T) {
 	// Initialize a MappingService instance.
 	ms := New( /* options */ )
 
@@ -110,41 +121,81 @@ func TestMappingService_UpdateMapping(t *testing.T) {
 	if err != nil {
 		t.Errorf("decode cid failed")
 	}
+	c2, err := cid.Decode("bafybeihgwe7rnrx7qe3fjugeixh4cyhsupaeq2ghnqdqtnbzsxnpu7lq4i")
+	if err != nil {
+		t.Errorf("decode cid failed")
+	}
+	c3, err := cid.Decode("bafybeia6bmpy3u5mgsd2z3z24ylxp6wfpyw2ezitsqnsvshwwmmmmkaxou")
+	if err != nil {
+		t.Errorf("decode cid failed")
+	}
 
-	// Create a mock ChunkMapping instance.
+	// Create mock ChunkMapping instances.
 	mockMapping1 := &types.ChunkMapping{
 		SrcPath:   "input/test1.json",
-		SrcOffset: 0,
 		Size:      93,
-		DstOffset: 14987673,
 		ChunkSize: 139,
 		NodeType:  2,
 		Cid:       c1,
 	}
-
-	// Insert the mock mappings into the mappings map for testing.
+	mockMapping2 := &types.ChunkMapping{
+		SrcPath:   "input/test2.json",
+		Size:      90,
+		ChunkSize: 136,
+		NodeType:  2,
+		Cid:       c2,
+	}
+	newService := func() *MappingService {
+		ms := New( /* options */ )
+		m1, m2 := *mockMapping1, *mockMapping2
+		if err := ms.insertMapping(c1, &m1, 93); err != nil {
+			t.Errorf("Error insert mapping: %v", err)
+		}
+		if err := ms.insertMapping(c2, &m2, 90); err != nil {
+			t.Errorf("Error insert mapping: %v", err)
+		}
+		return ms
+	}
+
+	// Blocks that do not match the mappings are an error once the car is finished.
+	for _, tc := range []struct {
+		blocks []CarBlock
+		err    string
+	}{
+		{[]CarBlock{{Cid: c1, Offset: 59, Size: 139}}, "mappings without block: 1 (" + c2.String() + ")"},
+		{[]CarBlock{{Cid: c1, Offset: 59, Size: 139}, {Cid: c2, Offset: 198, Size: 136}, {Cid: c1, Offset: 334, Size: 139}}, "duplicate blocks: 1 (" + c1.String() + " at 334)"},
+		{[]CarBlock{{Cid: c1, Offset: 59, Size: 139}, {Cid: c2, Offset: 198, Size: 136}, {Cid: c3, Offset: 334, Size: 10}}, "blocks without mapping: 1 (" + c3.String() + " at 334)"},
+		{[]CarBlock{{Cid: c1, Offset: 59, Size: 139}, {Cid: c2, Offset: 198, Size: 130}}, "blocks of another size than their mapping: 1 (" + c2.String() + " at 198)"},
+	} {
+		ms := newService()
+		for _, block := range tc.blocks {
+			ms.RecordCarBlock(block)
+		}
+		err := ms.FinishCarBlocks()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Expected error %q, but got %v", tc.err, err)
+		}
+	}
+
+	// Record the blocks of the mappings, the block of c2 is written before its mapping is inserted.
+	ms.RecordCarBlock(CarBlock{Cid: c2, Offset: 198, Size: 136})
 	if err := ms.insertMapping(c1, mockMapping1, 93); err != nil {
 		t.Errorf("Error insert mapping: %v", err)
 	}
-	var offset uint64 = 123
-	// Call the updateMapping function.
-	err = ms.updateMapping(mockMapping1.Cid, 123)
-	if err != nil {
-		t.Errorf("Error updating mapping: %v", err)
+	ms.RecordCarBlock(CarBlock{Cid: c1, Offset: 59, Size: 139})
+	if err := ms.insertMapping(c2, mockMapping2, 90); err != nil {
+		t.Errorf("Error insert mapping: %v", err)
 	}
-
-	if rs, ok := ms.chunkRawSize[mockMapping1.Cid]; ok {
-		sum := rs + uint64(len(mockMapping1.Cid.Bytes()))
-		buf := make([]byte, 8)
-		n := binary.PutUvarint(buf, sum)
-		offset = offset - uint64(n)
+	if err := ms.FinishCarBlocks(); err != nil {
+		t.Errorf("Error recording car blocks: %v", err)
 	}
 
-	// Perform assertions to verify the mapping was updated correctly.
-	updatedMapping := ms.mappings[mockMapping1.Cid]
-
-	if updatedMapping.DstOffset != 121 {
-		t.Errorf("Expected DstOffset to be updated to 121, but got %d", updatedMapping.DstOffset)
+	// Perform assertions to verify the offsets were recorded.
+	if ms.mappings[c1].DstOffset != 59 || ms.mappings[c2].DstOffset != 198 {
+		t.Errorf("Expected DstOffsets 59 and 198, but got %d and %d", ms.mappings[c1].DstOffset, ms.mappings[c2].DstOffset)
+	}
+	if _, err := ms.GetAllChunkMappings(); err != nil {
+		t.Errorf("Error getting chunk mappings: %v", err)
 	}
 }
 
@@ -231,6 +282,37 @@ func TestMappingService_GetChunkMappings(t *testing.T) {
 	}
 }
 
+func TestMappingService_GetChunkMappingsOverlap(t *testing.T) {
+	ms := New()
+
+	if err := ms.LoadMetaMappings("../testdata/output/metas/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.json"); err != nil {
+		t.Fatalf("Failed to load mappings: %v", err)
+	}
+	all, err := ms.GetAllChunkMappings()
+	if err != nil {
+		t.Fatalf("Failed to get chunks: %v", err)
+	}
+	carSize := all[len(all)-1].DstOffset + all[len(all)-1].ChunkSize
+
+	// Every mapping overlapping the range, bounds included, must be returned.
+	for _, size := range []uint64{0, 1, 140, 512} {
+		for offset := uint64(0); offset+size <= carSize; offset += 7 {
+			var expected []*types.ChunkMapping
+			for _, m := range all {
+				start, end := m.ChunkRangeInCar()
+				if start <= offset+size && end >= offset {
+					expected = append(expected, m)
+				}
+			}
+			mappings, _ := ms.GetChunkMappings(offset, size)
+			assert.Equal(t, len(mappings), len(expected))
+			for i := range mappings {
+				assert.Equal(t, mappings[i], expected[i])
+			}
+		}
+	}
+}
+
 func TestMappingService_GenerateChunksFromMappings(t *testing.T) {
 	// Create a new instance of MappingService
 	ms := New()
@@ -281,3 +363,279 @@ func TestMappingService_GenerateChunksFromMappings(t *testing.T) {
 		t.Fatalf("The generated chunks are inconsistent with the car generated directly from the source file.")
 	}
 }
+
+func TestMappingService_GenerateDirectoryNode(t *testing.T) {
+	// Initialize a MappingService instance.
+	ms := New()
+	ctx := context.Background()
+	dserv := ms.GenerateDagService(mdtest.Mock())
+
+	cidBuilder, err := merkledag.PrefixForCidVersion(1)
+	if err != nil {
+		t.Fatalf("Failed to get cid builder: %v", err)
+	}
+
+	// Build a small HAMT sharded directory and a plain directory linking to it.
+	shard, err := hamt.NewShard(dserv, 256)
+	if err != nil {
+		t.Fatalf("Failed to create shard: %v", err)
+	}
+	shard.SetCidBuilder(cidBuilder)
+	dir := merkledag.NodeWithData(unixfs.FolderPBData())
+	dir.SetCidBuilder(cidBuilder)
+	for i := 0; i < 20; i++ {
+		leaf := merkledag.NodeWithData(unixfs.FilePBData([]byte(fmt.Sprintf("file %d", i)), 6))
+		leaf.SetCidBuilder(cidBuilder)
+		if err := shard.Set(ctx, fmt.Sprintf("f%d", i), leaf); err != nil {
+			t.Fatalf("Failed to add shard entry: %v", err)
+		}
+		if i%4 == 0 {
+			if err := dir.AddNodeLink(fmt.Sprintf("f%d", i), leaf); err != nil {
+				t.Fatalf("Failed to add directory entry: %v", err)
+			}
+		}
+	}
+	shardNode, err := shard.Node()
+	if err != nil {
+		t.Fatalf("Failed to get shard node: %v", err)
+	}
+	if err := dir.AddNodeLink("shard", shardNode); err != nil {
+		t.Fatalf("Failed to add directory entry: %v", err)
+	}
+	if err := dserv.Add(ctx, dir); err != nil {
+		t.Fatalf("Failed to add directory: %v", err)
+	}
+
+	// Both directory nodes must be rebuilt from their mappings alone.
+	for _, c := range []cid.Cid{dir.Cid(), shardNode.Cid()} {
+		m, ok := ms.mappings[c]
+		if !ok {
+			t.Fatalf("Missing mapping for %s", c)
+		}
+		node, err := ms.GenerateNodeWithoutData(m, cidBuilder)
+		if err != nil {
+			t.Fatalf("Failed to generate node: %v", err)
+		}
+		assert.Equal(t, node.Cid(), c)
+	}
+}
+
+func TestMappingService_BinaryMetaMappings(t *testing.T) {
+	jsonPath := "../testdata/output/metas/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.json"
+	tempDir := t.TempDir()
+
+	// Convert the json mapping file to the binary format.
+	ms := New()
+	if err := ms.LoadMetaMappings(jsonPath); err != nil {
+		t.Fatalf("Failed to load mappings: %v", err)
+	}
+	expected, err := ms.GetChunkMappings(15653, 140)
+	if err != nil {
+		t.Fatalf("Failed to get chunks : %v", err)
+	}
+	if err := ms.SaveBinaryMetaMappings(tempDir, "test-meta"+MAPPING_BINARY_FILE_SUFFIX); err != nil {
+		t.Fatalf("Error saving binary meta mappings: %v", err)
+	}
+
+	binPath := filepath.Join(tempDir, "test-meta"+MAPPING_BINARY_FILE_SUFFIX)
+	assert.Assert(t, IsBinaryMappingFile(binPath))
+	assert.Assert(t, !IsBinaryMappingFile(jsonPath))
+
+	bms := New()
+	if err := bms.LoadMetaMappings(binPath); err != nil {
+		t.Fatalf("Failed to load binary mappings: %v", err)
+	}
+	assert.Equal(t, bms.dataRoot, ms.dataRoot)
+	assert.Equal(t, len(bms.mappings), 0)
+
+	// Only the overlapping records are read from the binary file.
+	mappings, err := bms.GetChunkMappings(15653, 140)
+	if err != nil {
+		t.Fatalf("Failed to get chunks : %v", err)
+	}
+	assert.Equal(t, len(mappings), len(expected))
+	for i := range mappings {
+		assert.Equal(t, mappings[i].Cid, expected[i].Cid)
+		assert.Equal(t, mappings[i].DstOffset, expected[i].DstOffset)
+	}
+
+	// The car rebuilt from the binary mappings matches the original one.
+	all, err := bms.GetAllChunkMappings()
+	if err != nil {
+		t.Fatalf("Failed to get chunks: %v", err)
+	}
+	carPath := filepath.Join(tempDir, "test_output.car")
+	if err := bms.GenerateChunksFromMappings(carPath, "../testdata", all); err != nil {
+		t.Fatalf("Failed to generate chunks car: %v", err)
+	}
+	buf, err := os.ReadFile(carPath)
+	if err != nil {
+		t.Fatalf("Failed to read chunks : %v", err)
+	}
+	carBuf, err := os.ReadFile("../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car")
+	if err != nil {
+		t.Fatalf("Failed to read car : %v", err)
+	}
+	assert.Equal(t, md5.Sum(buf), md5.Sum(carBuf))
+
+	// Converting back to json keeps every mapping.
+	if err := bms.SaveMetaMappings(tempDir, "test-meta.json"); err != nil {
+		t.Fatalf("Error saving meta mappings: %v", err)
+	}
+	jms := New()
+	if err := jms.LoadMetaMappings(filepath.Join(tempDir, "test-meta.json")); err != nil {
+		t.Fatalf("Failed to load mappings: %v", err)
+	}
+	assert.Equal(t, len(jms.mappings), len(ms.mappings))
+	assert.Equal(t, jms.dataRoot, ms.dataRoot)
+}
+
+func TestMappingService_DagParams(t *testing.T) {
+	for _, params := range []types.DagParams{
+		{Prefix: merkledag.V1CidPrefix(), Chunker: "size-64", Layout: libs.TrickleLayout, RawLeaves: true, MaxLinks: 3},
+		{Prefix: merkledag.V1CidPrefix(), Chunker: "size-64", Layout: libs.BalancedLayout, RawLeaves: true, MaxLinks: 3},
+		{Prefix: merkledag.V0CidPrefix(), Chunker: "rabin-32-64-128", Layout: libs.TrickleLayout, RawLeaves: false, MaxLinks: 2},
+		{Prefix: cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: mh.BLAKE3, MhLength: -1}, Chunker: "rabin-16-32-64", Layout: libs.BalancedLayout, RawLeaves: true, MaxLinks: 2},
+		{Prefix: cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: mh.BLAKE2B_MIN + 31, MhLength: -1}, Chunker: "size-100", Layout: libs.TrickleLayout, RawLeaves: false, MaxLinks: 3},
+	} {
+		// Build the DAG of a test file with the parameters, recording its mappings.
+		ms := New(DagParams(params))
+		f, err := os.Open("../testdata/input/test.txt")
+		if err != nil {
+			t.Fatalf("Failed to open input: %v", err)
+		}
+		defer f.Close()
+		spl, err := libs.NewSplitter(f, params.Chunker, "../testdata/input/test.txt", "../testdata", 0)
+		if err != nil {
+			t.Fatalf("Failed to create splitter: %v", err)
+		}
+		db, err := ms.GenerateHelper(&helpers.DagBuilderParams{
+			Maxlinks:   params.MaxLinks,
+			RawLeaves:  params.RawLeaves,
+			CidBuilder: params.Prefix,
+			Dagserv:    ms.GenerateDagService(mdtest.Mock()),
+		}, spl)
+		if err != nil {
+			t.Fatalf("Failed to create helper: %v", err)
+		}
+		root, err := libs.Layout(db, params.Layout)
+		if err != nil {
+			t.Fatalf("Failed to build dag: %v", err)
+		}
+		ms.SetCarDataRoot(root.Cid())
+
+		// The mapping files record the parameters, nodes are rebuilt with them without any option.
+		tempDir := t.TempDir()
+		if err := ms.SaveMetaMappings(tempDir, "test-meta.json"); err != nil {
+			t.Fatalf("Error saving meta mappings: %v", err)
+		}
+		if err := ms.SaveBinaryMetaMappings(tempDir, "test-meta.bin"); err != nil {
+			t.Fatalf("Error saving binary meta mappings: %v", err)
+		}
+		bms := New(RawLeaves(!params.RawLeaves))
+		if err := bms.LoadMetaMappings(filepath.Join(tempDir, "test-meta.bin")); err != nil {
+			t.Fatalf("Failed to load binary mappings: %v", err)
+		}
+		assert.Equal(t, bms.DagParams(), params)
+		lms := New(RawLeaves(!params.RawLeaves))
+		if err := lms.LoadMetaMappings(filepath.Join(tempDir, "test-meta.json")); err != nil {
+			t.Fatalf("Failed to load mappings: %v", err)
+		}
+		assert.Equal(t, lms.DagParams(), params)
+
+		reader := NewLocalSourceReader("../testdata")
+		var leaves int
+		for _, m := range lms.mappings {
+			if m.SrcPath != "" {
+				leaves++
+			}
+			node, err := lms.generateNode(reader, m, lms.CidBuilder())
+			if err != nil {
+				t.Fatalf("Failed to generate node %s with %+v: %v", m.Cid, params, err)
+			}
+			assert.Equal(t, node.Cid(), m.Cid)
+		}
+		assert.Assert(t, leaves > params.MaxLinks*params.MaxLinks, "the dag of %+v is not deep", params)
+	}
+}
+
+func TestMappingService_MappingVersion(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Mapping files of version 0 do not record the DAG parameters, the options are used.
+	ms := New(RawLeaves(true))
+	if err := ms.LoadMetaMappings("../testdata/output/metas/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.json"); err != nil {
+		t.Fatalf("Failed to load mappings: %v", err)
+	}
+	assert.Equal(t, ms.DagParams().RawLeaves, true)
+
+	// Mapping files of a later version are rejected rather than rebuilt with wrong parameters.
+	if err := utils.WriteJson(filepath.Join(tempDir, "next.json"), "\t", &types.Mapping{Version: MAPPING_VERSION + 1}); err != nil {
+		t.Fatalf("Failed to write mapping: %v", err)
+	}
+	assert.ErrorContains(t, New().LoadMetaMappings(filepath.Join(tempDir, "next.json")), "unsupported mapping version")
+
+	if err := utils.WriteJson(filepath.Join(tempDir, "noparams.json"), "\t", &types.Mapping{Version: MAPPING_VERSION}); err != nil {
+		t.Fatalf("Failed to write mapping: %v", err)
+	}
+	assert.ErrorContains(t, New().LoadMetaMappings(filepath.Join(tempDir, "noparams.json")), "no DAG parameters")
+}
+
+// newBenchMappingService creates a MappingService with n contiguous mappings of a car.
+func newBenchMappingService(b *testing.B, n int) *MappingService {
+	b.Helper()
+	ms := New()
+	var offset uint64 = 59
+	buf := make([]byte, 8)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(buf, uint64(i))
+		c := merkledag.NewRawNode(buf).Cid()
+		chunkSize := uint64(1000 + i%300)
+		ms.mappings[c] = &types.ChunkMapping{
+			Cid:       c,
+			NodeType:  2,
+			DstOffset: offset,
+			ChunkSize: chunkSize,
+			SrcPath:   "input/bench.bin",
+			SrcOffset: uint64(i) * 1024,
+			Size:      chunkSize - 40,
+		}
+		offset += chunkSize
+	}
+	return ms
+}
+
+func BenchmarkMappingService_GetChunkMappings(b *testing.B) {
+	for _, n := range []int{1 << 20, 1 << 21} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			ms := newBenchMappingService(b, n)
+			mappings, err := ms.GetAllChunkMappings()
+			if err != nil {
+				b.Fatalf("Failed to get chunks: %v", err)
+			}
+			carSize := mappings[n-1].DstOffset + mappings[n-1].ChunkSize
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dstOffset := uint64(i) * 2654435761 % (carSize - CAR_2MIB_CHUNK_SIZE)
+				if _, err := ms.GetChunkMappings(dstOffset, CAR_2MIB_CHUNK_SIZE); err != nil {
+					b.Fatalf("Failed to get chunks : %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMappingService_SortedIndex(b *testing.B) {
+	for _, n := range []int{1 << 20, 1 << 21} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			ms := newBenchMappingService(b, n)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ms.sorted = nil
+				ms.sortedIndex()
+			}
+		})
+	}
+}
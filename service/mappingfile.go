@@ -0,0 +1,425 @@
+package metaservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/dataswap/go-metadata/types"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	pb "github.com/ipfs/go-unixfs/pb"
+)
+
+const (
+	MAPPING_BINARY_FILE_SUFFIX = ".bin"
+	// number of records between two entries of the sparse index
+	MAPPING_INDEX_INTERVAL = 128
+
+	mappingIndexEntrySize = 16
+	mappingFooterSize     = 16 + len(mappingMagic)
+)
+
+// Binary mapping file layout, integers in records are uvarints and fixed integers are little endian:
+//
+//	magic | dataRoot(len, bytes) | meta(len, json) | count | records sorted by DstOffset | index | indexOffset(8) | indexCount(8) | magic
+//
+// A record is its length followed by cid, nodetype, dstoffset, chunksize, blocksize, srcpath, srcoffset, size, data
+// and the links (count, then cid, name and size of each). An index entry is the DstOffset and file offset(8+8) of
+// every MAPPING_INDEX_INTERVAL-th record. The meta holds the mapping schema version and the DAG parameters.
+const mappingMagic = "dsmap\x00v1"
+
+// mappingMeta is the meta of the header of a binary mapping file.
+type mappingMeta struct {
+	Version uint64           `json:"version"`
+	Params  *types.DagParams `json:"params,omitempty"`
+}
+
+var errMappingRecord = errors.New("malformed mapping record")
+
+// mappingIndexEntry locates a record of a binary mapping file.
+type mappingIndexEntry struct {
+	DstOffset  uint64
+	FileOffset uint64
+}
+
+// mappingFile is an opened binary mapping file, only its header and sparse index are held in memory.
+type mappingFile struct {
+	path     string
+	dataRoot cid.Cid
+	version  uint64
+	params   *types.DagParams // nil if the DAG parameters were not recorded
+	count    uint64
+	start    uint64 // file offset of the first record
+	end      uint64 // file offset after the last record
+	index    []mappingIndexEntry
+}
+
+// IsBinaryMappingFile reports whether path is a mapping file in the binary format.
+func IsBinaryMappingFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(mappingMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == mappingMagic
+}
+
+// writeMappingFile writes the mappings, which must be sorted by DstOffset, in the binary format.
+func writeMappingFile(path string, dataRoot cid.Cid, version uint64, params *types.DagParams, mappings []*types.ChunkMapping) error {
+	meta, err := json.Marshal(&mappingMeta{Version: version, Params: params})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var offset uint64
+	write := func(b []byte) error {
+		n, err := w.Write(b)
+		offset += uint64(n)
+		return err
+	}
+
+	header := []byte(mappingMagic)
+	header = appendBytes(header, rootBytes(dataRoot))
+	header = appendBytes(header, meta)
+	header = binary.AppendUvarint(header, uint64(len(mappings)))
+	if err := write(header); err != nil {
+		return err
+	}
+
+	index := make([]mappingIndexEntry, 0, len(mappings)/MAPPING_INDEX_INTERVAL+1)
+	var record []byte
+	for i, m := range mappings {
+		if i%MAPPING_INDEX_INTERVAL == 0 {
+			index = append(index, mappingIndexEntry{DstOffset: m.DstOffset, FileOffset: offset})
+		}
+		record = appendMappingRecord(record[:0], m)
+		if err := write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+			return err
+		}
+		if err := write(record); err != nil {
+			return err
+		}
+	}
+
+	indexOffset := offset
+	entry := make([]byte, mappingIndexEntrySize)
+	for _, e := range index {
+		binary.LittleEndian.PutUint64(entry[:8], e.DstOffset)
+		binary.LittleEndian.PutUint64(entry[8:], e.FileOffset)
+		if err := write(entry); err != nil {
+			return err
+		}
+	}
+
+	footer := binary.LittleEndian.AppendUint64(nil, indexOffset)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(index)))
+	footer = append(footer, mappingMagic...)
+	if err := write(footer); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// openMappingFile reads the header and the sparse index of a binary mapping file.
+func openMappingFile(path string) (*mappingFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < int64(len(mappingMagic)+mappingFooterSize) {
+		return nil, fmt.Errorf("mapping file %s is too short", path)
+	}
+
+	footer := make([]byte, mappingFooterSize)
+	if _, err := f.ReadAt(footer, stat.Size()-int64(mappingFooterSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[16:]) != mappingMagic {
+		return nil, fmt.Errorf("mapping file %s has no binary mapping footer", path)
+	}
+	indexOffset := binary.LittleEndian.Uint64(footer[:8])
+	indexCount := binary.LittleEndian.Uint64(footer[8:16])
+	if indexOffset+indexCount*mappingIndexEntrySize != uint64(stat.Size())-uint64(mappingFooterSize) {
+		return nil, fmt.Errorf("mapping file %s has a corrupted index", path)
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, 0, int64(indexOffset)))
+	magic := make([]byte, len(mappingMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != mappingMagic {
+		return nil, fmt.Errorf("mapping file %s is not in the binary mapping format", path)
+	}
+	root, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mf := &mappingFile{
+		path:     path,
+		dataRoot: cid.Undef,
+		count:    count,
+		start:    uint64(len(mappingMagic) + len(appendBytes(nil, root)) + len(appendBytes(nil, meta)) + len(binary.AppendUvarint(nil, count))),
+		end:      indexOffset,
+		index:    make([]mappingIndexEntry, indexCount),
+	}
+	if len(root) != 0 {
+		if mf.dataRoot, err = cid.Cast(root); err != nil {
+			return nil, err
+		}
+	}
+	if len(meta) != 0 {
+		var mm mappingMeta
+		if err := json.Unmarshal(meta, &mm); err != nil {
+			return nil, fmt.Errorf("mapping file %s has a malformed meta: %w", path, err)
+		}
+		mf.version, mf.params = mm.Version, mm.Params
+	}
+
+	index := make([]byte, indexCount*mappingIndexEntrySize)
+	if _, err := f.ReadAt(index, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	for i := range mf.index {
+		entry := index[i*mappingIndexEntrySize : (i+1)*mappingIndexEntrySize]
+		mf.index[i] = mappingIndexEntry{
+			DstOffset:  binary.LittleEndian.Uint64(entry[:8]),
+			FileOffset: binary.LittleEndian.Uint64(entry[8:]),
+		}
+	}
+
+	return mf, nil
+}
+
+// chunkMappings reads only the records overlapping the car range [start, end], both ends inclusive.
+func (mf *mappingFile) chunkMappings(start uint64, end uint64) ([]*types.ChunkMapping, error) {
+	mappings := make([]*types.ChunkMapping, 0)
+	if len(mf.index) == 0 {
+		return mappings, nil
+	}
+
+	// Records before the last indexed one starting before start all end before start.
+	i := sort.Search(len(mf.index), func(i int) bool {
+		return mf.index[i].DstOffset >= start
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	err := mf.scan(mf.index[i].FileOffset, func(m *types.ChunkMapping) bool {
+		s, e := m.ChunkRangeInCar()
+		if s > end {
+			return false
+		}
+		if e >= start {
+			mappings = append(mappings, m)
+		}
+		return true
+	})
+	return mappings, err
+}
+
+// all reads every record.
+func (mf *mappingFile) all() ([]*types.ChunkMapping, error) {
+	mappings := make([]*types.ChunkMapping, 0, mf.count)
+	err := mf.scan(mf.start, func(m *types.ChunkMapping) bool {
+		mappings = append(mappings, m)
+		return true
+	})
+	return mappings, err
+}
+
+// last reads the record with the largest DstOffset, nil if there is none.
+func (mf *mappingFile) last() (*types.ChunkMapping, error) {
+	if len(mf.index) == 0 {
+		return nil, nil
+	}
+
+	var last *types.ChunkMapping
+	err := mf.scan(mf.index[len(mf.index)-1].FileOffset, func(m *types.ChunkMapping) bool {
+		last = m
+		return true
+	})
+	return last, err
+}
+
+// scan reads the records from the file offset on until fn returns false.
+func (mf *mappingFile) scan(offset uint64, fn func(m *types.ChunkMapping) bool) error {
+	f, err := os.Open(mf.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.NewSectionReader(f, int64(offset), int64(mf.end-offset)))
+	for {
+		record, err := readBytes(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m, err := decodeMappingRecord(record)
+		if err != nil {
+			return err
+		}
+		if !fn(m) {
+			return nil
+		}
+	}
+}
+
+func appendMappingRecord(buf []byte, m *types.ChunkMapping) []byte {
+	buf = appendBytes(buf, m.Cid.Bytes())
+	buf = binary.AppendUvarint(buf, uint64(m.NodeType))
+	buf = binary.AppendUvarint(buf, m.DstOffset)
+	buf = binary.AppendUvarint(buf, m.ChunkSize)
+	buf = binary.AppendUvarint(buf, m.BlockSize)
+	buf = appendBytes(buf, []byte(m.SrcPath))
+	buf = binary.AppendUvarint(buf, m.SrcOffset)
+	buf = binary.AppendUvarint(buf, m.Size)
+	buf = appendBytes(buf, m.Data)
+	buf = binary.AppendUvarint(buf, uint64(len(m.Links)))
+	for _, link := range m.Links {
+		buf = appendBytes(buf, link.Cid.Bytes())
+		buf = appendBytes(buf, []byte(link.Name))
+		buf = binary.AppendUvarint(buf, link.Size)
+	}
+	return buf
+}
+
+func decodeMappingRecord(record []byte) (*types.ChunkMapping, error) {
+	r := bytes.NewReader(record)
+	m := &types.ChunkMapping{}
+
+	c, err := readCid(r)
+	if err != nil {
+		return nil, err
+	}
+	m.Cid = c
+
+	var nodeType uint64
+	var srcPath []byte
+	for _, v := range []*uint64{&nodeType, &m.DstOffset, &m.ChunkSize, &m.BlockSize} {
+		if *v, err = binary.ReadUvarint(r); err != nil {
+			return nil, errMappingRecord
+		}
+	}
+	m.NodeType = pb.Data_DataType(nodeType)
+	if srcPath, err = readBytes(r); err != nil {
+		return nil, errMappingRecord
+	}
+	m.SrcPath = string(srcPath)
+	for _, v := range []*uint64{&m.SrcOffset, &m.Size} {
+		if *v, err = binary.ReadUvarint(r); err != nil {
+			return nil, errMappingRecord
+		}
+	}
+	if m.Data, err = readBytes(r); err != nil {
+		return nil, errMappingRecord
+	}
+	if len(m.Data) == 0 {
+		m.Data = nil
+	}
+
+	links, err := binary.ReadUvarint(r)
+	if err != nil || links > uint64(r.Len()) {
+		return nil, errMappingRecord
+	}
+	m.Links = make([]*ipld.Link, links)
+	for i := range m.Links {
+		link := &ipld.Link{}
+		if link.Cid, err = readCid(r); err != nil {
+			return nil, err
+		}
+		name, err := readBytes(r)
+		if err != nil {
+			return nil, errMappingRecord
+		}
+		link.Name = string(name)
+		if link.Size, err = binary.ReadUvarint(r); err != nil {
+			return nil, errMappingRecord
+		}
+		m.Links[i] = link
+	}
+
+	if r.Len() != 0 {
+		return nil, errMappingRecord
+	}
+	return m, nil
+}
+
+func readCid(r *bytes.Reader) (cid.Cid, error) {
+	b, err := readBytes(r)
+	if err != nil {
+		return cid.Undef, errMappingRecord
+	}
+	return cid.Cast(b)
+}
+
+// readBytes reads a uvarint length prefixed byte slice.
+func readBytes(r interface {
+	io.Reader
+	io.ByteReader
+}) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<30 {
+		return nil, errMappingRecord
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func rootBytes(root cid.Cid) []byte {
+	if !root.Defined() {
+		return nil
+	}
+	return root.Bytes()
+}
@@ -1,16 +1,32 @@
 package metaservice
 
+import (
+	"github.com/dataswap/go-metadata/libs"
+	"github.com/dataswap/go-metadata/types"
+	"github.com/ipfs/go-merkledag"
+)
+
 type Options struct {
-	rawLeaves        bool   //Are the leaf nodes of the DAG of raw type?
-	metaPath         string //paths for the mapping file and proof file.
-	sourceParentPath string //Root directory of the source data.
+	dagParams        types.DagParams //Parameters the DAG is built with, recorded in the mapping file.
+	metaPath         string          //paths for the mapping file and proof file.
+	sourceParentPath string          //Root directory of the source data.
+	sourceReader     SourceReader    //Reader of the source data, overrides the source parent path.
+	spillPath        string          //Directory the mappings placed in the car are spilled to.
+	spillLimit       int             //Number of placed mappings kept in memory before they are spilled, 0 to keep them all.
+	recordInto       *MappingService //Service the mappings recorded are recorded in as well.
 }
 
 type Option func(o *Options)
 
 func newOptions(opts ...Option) *Options {
 	options := Options{
-		rawLeaves: false,
+		dagParams: types.DagParams{
+			Prefix:    merkledag.V1CidPrefix(),
+			Chunker:   libs.DefaultChunker,
+			Layout:    libs.BalancedLayout,
+			RawLeaves: false,
+			MaxLinks:  libs.UnixfsLinksPerLevel,
+		},
 	}
 
 	for _, o := range opts {
@@ -22,7 +38,13 @@ func newOptions(opts ...Option) *Options {
 
 func RawLeaves(rawLeaves bool) Option {
 	return func(o *Options) {
-		o.rawLeaves = rawLeaves
+		o.dagParams.RawLeaves = rawLeaves
+	}
+}
+
+func DagParams(params types.DagParams) Option {
+	return func(o *Options) {
+		o.dagParams = params
 	}
 }
 
@@ -37,3 +59,27 @@ func SourceParentPath(path string) Option {
 		o.sourceParentPath = path
 	}
 }
+
+func Source(reader SourceReader) Option {
+	return func(o *Options) {
+		o.sourceReader = reader
+	}
+}
+
+// SpillMappings spills the mappings placed in the car to runs under path once there are limit of them in memory,
+// so collecting the mappings of a car takes a bounded memory. The runs are merged when the mappings are saved.
+// The car recorded by RecordCarBlocks spills the offsets of its blocks under path by limit as well.
+func SpillMappings(path string, limit int) Option {
+	return func(o *Options) {
+		o.spillPath = path
+		o.spillLimit = limit
+	}
+}
+
+// RecordInto records the mappings in ms as well, as they are recorded, so the mappings of a file are collected on
+// their own while the car of ms places them.
+func RecordInto(ms *MappingService) Option {
+	return func(o *Options) {
+		o.recordInto = ms
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
@@ -13,7 +12,6 @@ import (
 	"path"
 	"reflect"
 	"sort"
-	"sync"
 
 	"github.com/dataswap/go-metadata/utils"
 	commcid "github.com/filecoin-project/go-fil-commcid"
@@ -50,24 +48,26 @@ const (
 	MaxLayers = uint(31) // result of log2( 64 GiB / 32 )
 	// MaxPieceSize is the current maximum size of the rust-fil-proofs proving tree.
 	MaxPieceSize = uint64(1 << (MaxLayers + 5))
+	// MaxPaddedDataBlocksSize is the largest target padded size of the padded data blocks, every leaf of the
+	// target is held, the commP of a larger piece is padded by PadCommP.
+	MaxPaddedDataBlocksSize = uint64(64 << 20)
 )
 
 var (
-	StackedNulPadding [MaxLayers][]byte
-	SumChunkCount     uint64
+	// the root of the nul subtree of every height, it must not be modified.
+	StackedNulPadding = newStackedNulPadding()
 	CommpHashConfig   = &mt.Config{
 		HashFunc:           NewHashFunc,
 		DisableLeafHashing: true,
 		Mode:               mt.ModeTreeBuild,
 		RunInParallel:      true,
 	}
-
-	Once sync.Once
 )
 
 // ### export functions
 
-// PadCommP is experimental, do not use it.
+// PadCommP pads the commP of a piece of sourcePaddedSize to the commP of the piece followed by zeros up to
+// targetPaddedSize, e.g. a sector size. It hashes a nul subtree per level, so large pieces are padded cheaply.
 func PadCommP(sourceCommP []byte, sourcePaddedSize, targetPaddedSize uint64) ([]byte, error) {
 
 	if len(sourceCommP) != 32 {
@@ -141,17 +141,17 @@ func SaveCommP(rawCommP []byte, carSize uint64, cachePath string) error {
 	return nil
 }
 
-// GenCommP is the commP generate. targetPaddedSize = 0 is use default padded size
+// GenCommP is the commP generate. targetPaddedSize = 0 is use default padded size, otherwise the commP is padded
+// to targetPaddedSize by PadCommP, the level cache is the one of the tree of the data.
 func GenCommP(buf bytes.Buffer, cachePath string, targetPaddedSize uint64) ([]byte, uint64, error) {
 
-	blocks, paddedPieceSize, err := NewPaddedDataBlocksFromBuffer(buf, targetPaddedSize)
+	blocks, paddedPieceSize, err := NewPaddedDataBlocksFromBuffer(buf, 0)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	tree, _ := mt.NewWithPadding(CommpHashConfig, blocks, StackedNulPadding)
 
-	// paddedPieceSize := SumChunkCount * SLAB_CHUNK_SIZE
 	// hacky round-up-to-next-pow2
 	if bits.OnesCount64(paddedPieceSize) != 1 {
 		paddedPieceSize = 1 << uint(64-bits.LeadingZeros64(paddedPieceSize))
@@ -165,12 +165,25 @@ func GenCommP(buf bytes.Buffer, cachePath string, targetPaddedSize uint64) ([]by
 		log.Error(err)
 		return nil, 0, err
 	}
-	cPath := createPath(cachePath, hex.EncodeToString(tree.Root)+CACHE_SUFFIX)
+	// the level cache is named by the piece CID of the data, as GenChallengeProof loads it.
+	commCid, err := commcid.DataCommitmentV1ToCID(tree.Root)
+	if err != nil {
+		return nil, 0, err
+	}
+	cPath := createPath(cachePath, commCid.String()+CACHE_SUFFIX)
 	if err = lc.StoreToFile(cPath); err != nil {
 		log.Error(err)
 		return nil, 0, err
 	}
 
+	if targetPaddedSize != 0 {
+		rawCommP, err := PadCommP(tree.Root, paddedPieceSize, targetPaddedSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		return rawCommP, targetPaddedSize, nil
+	}
+
 	return tree.Root, paddedPieceSize, nil
 }
 
@@ -254,8 +267,8 @@ func VerifyDatasetProof(cachePath string, randomness uint64) (bool, *mt.Proof, e
 	}
 }
 
-// Generate challenge nodes Proofs
-func GenChallengeProof(randomness uint64, cachePath string) (*Proofs, error) {
+// Generate challenge nodes Proofs, the challenged car chunks are read from provider.
+func GenChallengeProof(randomness uint64, cachePath string, provider ChunkProvider) (*Proofs, error) {
 
 	// 1. Generate challenge nodes
 	commPs, carSize := LoadSortCommp(cachePath)
@@ -275,7 +288,7 @@ func GenChallengeProof(randomness uint64, cachePath string) (*Proofs, error) {
 				return nil, err
 			}
 			offset := uint64((leafIndex / carChunkNodes) * carChunkSize)
-			buf, err := GetChallengeChunk(commCid, offset, carChunkSize)
+			buf, err := provider.GetChunk(commCid, offset, carChunkSize)
 			if err != nil {
 				return nil, err
 			}
@@ -289,10 +302,16 @@ func GenChallengeProof(randomness uint64, cachePath string) (*Proofs, error) {
 			if err != nil {
 				return nil, err
 			}
+			// the last chunk of a car may be partial, lift its root up to the cache layer.
+			for h := len(proof.Siblings); h < CarCacheLayerStart(carSize[challenge.CarIndex]); h++ {
+				root, _ = NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), root...), StackedNulPadding[h]...))
+				proof.Siblings = append(proof.Siblings, StackedNulPadding[h])
+				proof.Path |= 1 << h
+			}
 
 			// 4. Generate a car cache proof
 			cPath := createPath(cachePath, commCid.String()+CACHE_SUFFIX)
-			cacheProof, _, err := GenProofFromCache(NewDataBlockFromBytes(root), cPath)
+			cacheProof, _, err := GenProofFromCacheAt(leafIndex/carChunkNodes, root, cPath)
 			if err != nil {
 				return nil, err
 			}
@@ -381,7 +400,6 @@ func NewHashFunc(data []byte) ([]byte, error) {
 func DataPadding(inSlab []byte) []byte {
 
 	chunkCount := len(inSlab) / SOURCE_CHUNK_SIZE
-	SumChunkCount += uint64(chunkCount)
 	outSlab := make([]byte, chunkCount*SLAB_CHUNK_SIZE)
 
 	for j := 0; j < chunkCount; j++ {
@@ -594,6 +612,48 @@ func GenProof(blocks []mt.DataBlock, leaf mt.DataBlock) (*mt.Proof, []byte, erro
 	return proof, tree.Root, nil
 }
 
+// GenProofAt generates a Merkle tree proof for the leaf at index of the blocks, padded with nul subtrees.
+// Unlike GenProof the leaf is not looked up by its hash, so leaves with identical data can be proven as well.
+// It returns the proof, the root hash of the Merkle tree, and any error encountered.
+func GenProofAt(blocks []mt.DataBlock, index uint64) (*mt.Proof, []byte, error) {
+	if index >= uint64(len(blocks)) {
+		return nil, nil, xerrors.Errorf("leaf index %d is out of the range %d", index, len(blocks))
+	}
+
+	level := make([][]byte, len(blocks))
+	for i, block := range blocks {
+		data, err := block.Serialize()
+		if err != nil {
+			return nil, nil, err
+		}
+		level[i] = data
+	}
+
+	proof := &mt.Proof{}
+	for h := 0; len(level) > 1; h++ {
+		if len(level)%2 == 1 {
+			level = append(level, StackedNulPadding[h])
+		}
+		if index&1 == 0 {
+			proof.Path |= 1 << h
+		}
+		proof.Siblings = append(proof.Siblings, level[index^1])
+
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			node, err := NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), level[2*i]...), level[2*i+1]...))
+			if err != nil {
+				return nil, nil, err
+			}
+			next[i] = node
+		}
+		level = next
+		index >>= 1
+	}
+
+	return proof, level[0], nil
+}
+
 // GenProofFromCache generates a Merkle tree proof for the specified leaf block using a level cache.
 // It takes the leaf block and the cache file path as input.
 // It returns the proof, the root hash of the Merkle tree, and any error encountered.
@@ -607,6 +667,45 @@ func GenProofFromCache(leaf mt.DataBlock, file string) (*mt.Proof, []byte, error
 	return lc.Prove(leaf, CommpHashConfig)
 }
 
+// GenProofFromCacheAt generates a Merkle tree proof for the node at the given index of the level cache start layer.
+// Unlike GenProofFromCache the node is not looked up by its hash, so the partial last chunk of a car and chunks
+// with identical data can be proven as well.
+// It returns the proof, the root hash of the Merkle tree, and any error encountered.
+func GenProofFromCacheAt(index uint64, node []byte, file string) (*mt.Proof, []byte, error) {
+	lc, err := mt.NewLevelCacheFromFile(file)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("load level cache %s: %w", file, err)
+	}
+
+	proof := &mt.Proof{}
+	if lc.Level == 0 {
+		return proof, node, nil
+	}
+	if index >= uint64(len(lc.Nodes[0])) {
+		return nil, nil, xerrors.Errorf("node index %d is out of the level cache range %d", index, len(lc.Nodes[0]))
+	}
+	if !bytes.Equal(lc.Nodes[0][index], node) {
+		return nil, nil, xerrors.Errorf("node %d does not match the level cache", index)
+	}
+
+	for i := 0; i < lc.Level; i++ {
+		sibling := lc.Nodes[i][index^1]
+		if index&1 == 0 {
+			proof.Path |= 1 << i
+			node, err = NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), node...), sibling...))
+		} else {
+			node, err = NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), sibling...), node...))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		proof.Siblings = append(proof.Siblings, sibling)
+		index >>= 1
+	}
+
+	return proof, node, nil
+}
+
 // Append base and sub proof
 func AppendProof(base *mt.Proof, sub mt.Proof) (*mt.Proof, error) {
 	if base == nil {
@@ -617,17 +716,19 @@ func AppendProof(base *mt.Proof, sub mt.Proof) (*mt.Proof, error) {
 
 //### internal functions
 
-// initialize the nul padding stack
-func initStackedNulPadding() {
+// generate the nul padding stack
+func newStackedNulPadding() [MaxLayers][]byte {
+	var padding [MaxLayers][]byte
 	digest := sha256.New()
-	StackedNulPadding[0] = make([]byte, sha256.Size)
+	padding[0] = make([]byte, sha256.Size)
 	for i := uint(1); i < MaxLayers; i++ {
 		digest.Reset()
-		digest.Write(StackedNulPadding[i-1]) // yes, got to...
-		digest.Write(StackedNulPadding[i-1]) // ...do it twice
-		StackedNulPadding[i] = digest.Sum(make([]byte, 0, sha256.Size))
-		StackedNulPadding[i][31] &= 0x3F
+		digest.Write(padding[i-1]) // yes, got to...
+		digest.Write(padding[i-1]) // ...do it twice
+		padding[i] = digest.Sum(make([]byte, 0, sha256.Size))
+		padding[i][31] &= 0x3F
 	}
+	return padding
 }
 
 // createPath creates a directory path and returns the full file path by joining the directory path with the file name.
@@ -53,49 +53,21 @@ type CarChallenge struct {
 // Padding DataBlock, commp leaf node use
 // targetPaddedSize = 0 use default paddedSize
 func NewPaddedDataBlocksFromBuffer(buf bytes.Buffer, targetPaddedSize uint64) ([]mt.DataBlock, uint64, error) {
-	// padding stack
-	Once.Do(initStackedNulPadding)
-
-	srcLen := buf.Len()
-
-	// Padding source data
-	if mod := srcLen % SOURCE_CHUNK_SIZE; mod != 0 {
-		// fmt.Println("total padlen: ", SOURCE_CHUNK_SIZE-mod, ", srcLen: ", srcLen)
-		buf.Write(make([]byte, SOURCE_CHUNK_SIZE-mod))
-		srcLen = buf.Len()
-	}
-
-	// Struce blocks from source data
-	idx := 0
-	blocks := make([]mt.DataBlock, srcLen*CHUNK_NODES_NUM/SOURCE_CHUNK_SIZE)
-	for j := 0; j < srcLen/SOURCE_CHUNK_SIZE; j++ {
-		nodes := DataPadding(buf.Bytes()[j*SOURCE_CHUNK_SIZE : (j+1)*SOURCE_CHUNK_SIZE])
-		for b := 0; b < CHUNK_NODES_NUM; b++ {
-			block := &DataBlock{
-				Data: nodes[b*NODE_SIZE : (b+1)*NODE_SIZE],
-			}
-			blocks[idx] = block
-			idx++
-		}
-	}
-
-	sourcePaddedSize := uint64((srcLen / SOURCE_CHUNK_SIZE) * SLAB_CHUNK_SIZE)
-	if targetPaddedSize != 0 {
-		blocks, err := NewPaddedDataBlocksFromDataBlocks(blocks, sourcePaddedSize, targetPaddedSize)
-		if err != nil {
-			return nil, 0, err
-		}
-		return blocks, targetPaddedSize, nil
-	}
-
-	return blocks, sourcePaddedSize, nil
+	return defaultCommPCalculator.PaddedDataBlocks(buf, targetPaddedSize)
 }
 
 // Padding DataBlock, commp leaf node use
 // targetPaddedSize = 0 use default paddedSize
 func NewPaddedDataBlocksFromDataBlocks(dataBlocks []mt.DataBlock, sourcePaddedSize, targetPaddedSize uint64) ([]mt.DataBlock, error) {
-	if bits.OnesCount64(sourcePaddedSize) != 1 {
-		return nil, xerrors.Errorf("source padded size %d is not a power of 2", sourcePaddedSize)
+	return defaultCommPCalculator.paddedDataBlocks(dataBlocks, sourcePaddedSize, targetPaddedSize)
+}
+
+// paddedDataBlocks pads the leaves of sourcePaddedSize with zero leaves to targetPaddedSize, the root of their tree
+// is the commP padded by PadCommP. Every leaf of the target is held, so targets above MaxPaddedDataBlocksSize are
+// rejected, PadCommP pads the commP of a large piece.
+func (c *CommPCalculator) paddedDataBlocks(dataBlocks []mt.DataBlock, sourcePaddedSize, targetPaddedSize uint64) ([]mt.DataBlock, error) {
+	if sourcePaddedSize%SLAB_CHUNK_SIZE != 0 {
+		return nil, xerrors.Errorf("source padded size %d is not a multiple of %d", sourcePaddedSize, SLAB_CHUNK_SIZE)
 	}
 	if bits.OnesCount64(targetPaddedSize) != 1 {
 		return nil, xerrors.Errorf("target padded size %d is not a power of 2", targetPaddedSize)
@@ -114,12 +86,13 @@ func NewPaddedDataBlocksFromDataBlocks(dataBlocks []mt.DataBlock, sourcePaddedSi
 	if sourcePaddedSize == targetPaddedSize {
 		return dataBlocks, nil
 	}
+	if targetPaddedSize > MaxPaddedDataBlocksSize {
+		return nil, xerrors.Errorf("target padded size %d larger than the %d bytes of padded data blocks, pad the commP with PadCommP", targetPaddedSize, MaxPaddedDataBlocksSize)
+	}
 
-	s := bits.TrailingZeros64(sourcePaddedSize)
-	t := bits.TrailingZeros64(targetPaddedSize)
-
-	for ; s < t; s++ {
-		dataBlocks = append(dataBlocks, &DataBlock{Data: StackedNulPadding[s-5]})
+	nul := &DataBlock{Data: c.nulPadding[0]}
+	for n := uint64(len(dataBlocks)); n < targetPaddedSize/NODE_SIZE; n++ {
+		dataBlocks = append(dataBlocks, nul)
 	}
 
 	return dataBlocks, nil
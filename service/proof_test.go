@@ -4,11 +4,10 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
-	"encoding/hex"
 	"fmt"
 	"math/big"
 	"os"
-	"path"
+	"sync"
 	"testing"
 
 	commcid "github.com/filecoin-project/go-fil-commcid"
@@ -20,6 +19,7 @@ import (
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	mt "github.com/txaty/go-merkletree"
 )
 
 func TestGenCommP(t *testing.T) {
@@ -82,12 +82,12 @@ func TestChallengeProof(t *testing.T) {
 	randomness, _ := rand.Int(rand.Reader, big.NewInt(100))
 	cachePath := "../testdata/output"
 
-	MappingServiceInstance(
+	provider := NewMappingChunkProvider(
 		MetaPath("../testdata/output/metas"),
 		SourceParentPath("../testdata"),
 	)
 
-	_, err := GenChallengeProof(randomness.Uint64(), cachePath)
+	_, err := GenChallengeProof(randomness.Uint64(), cachePath, provider)
 	if err != nil {
 		t.Errorf("Proof fail: %s", err)
 	}
@@ -98,6 +98,85 @@ func TestChallengeProof(t *testing.T) {
 	}
 }
 
+func TestChallengeProofLastChunk(t *testing.T) {
+
+	saveCommpCache()
+	cachePath := "../testdata/output"
+
+	provider := NewMappingChunkProvider(
+		MetaPath("../testdata/output/metas"),
+		SourceParentPath("../testdata"),
+	)
+
+	// enough seeds to challenge the partial last chunk of both cars.
+	for randomness := uint64(0); randomness < 32; randomness++ {
+		_, err := GenChallengeProof(randomness, cachePath, provider)
+		if err != nil {
+			t.Fatalf("Proof fail with randomness %d: %s", randomness, err)
+		}
+
+		bl, err := VerifyChallengeProof(cachePath)
+		if err != nil || !bl {
+			t.Fatalf("VerifyChallengeProof fail with randomness %d: %s, bl:%t", randomness, err, bl)
+		}
+	}
+}
+
+func TestMappingChunkProviderConcurrent(t *testing.T) {
+	commCid, err := cid.Parse("baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi")
+	if err != nil {
+		t.Fatalf("Parse err: %s", err)
+	}
+	carBuf, err := os.ReadFile("../testdata/output/" + commCid.String() + ".car")
+	if err != nil {
+		t.Fatalf("Failed to read car : %s", err)
+	}
+
+	provider := NewMappingChunkProvider(
+		MetaPath("../testdata/output/metas"),
+		SourceParentPath("../testdata"),
+	)
+
+	// the chunks are rebuilt concurrently from the mapping file of the piece, loaded once.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(carBuf)/int(CAR_512B_CHUNK_SIZE)+1)
+	for offset := uint64(0); offset < uint64(len(carBuf)); offset += CAR_512B_CHUNK_SIZE {
+		wg.Add(1)
+		go func(offset uint64) {
+			defer wg.Done()
+			buf, err := provider.GetChunk(commCid, offset, CAR_512B_CHUNK_SIZE)
+			if err != nil {
+				errs <- err
+				return
+			}
+			end := offset + CAR_512B_CHUNK_SIZE
+			if end > uint64(len(carBuf)) {
+				end = uint64(len(carBuf))
+			}
+			if !bytes.Equal(buf, carBuf[offset:end]) {
+				errs <- fmt.Errorf("chunk at %d differs from the car", offset)
+			}
+		}(offset)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if len(provider.cars) != 1 {
+		t.Errorf("the mappings of %d pieces are loaded, expected 1", len(provider.cars))
+	}
+
+	// a piece without a mapping file fails every time.
+	other, _ := cid.Parse("baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq")
+	for i := 0; i < 2; i++ {
+		if _, err := provider.GetChunk(other, 0, CAR_512B_CHUNK_SIZE); err == nil {
+			t.Errorf("GetChunk of a piece without mappings is expected to fail")
+		}
+	}
+}
+
 func allSelector() ipldprime.Node {
 	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
 	return ssb.ExploreRecursive(selector.RecursionLimitNone(),
@@ -135,11 +214,87 @@ func saveCommpCache() {
 			fmt.Println("GenCommP err")
 		}
 		SaveCommP(rawCommP, uint64(buf.Len()), cachePath)
+	}
+}
 
-		commCid, _ := commcid.DataCommitmentV1ToCID(rawCommP)
-		err = os.Rename(path.Join(cachePath, hex.EncodeToString(rawCommP)+".cache"), path.Join(cachePath, commCid.String()+".cache"))
+func TestPadCommP(t *testing.T) {
+	cachePath := t.TempDir()
+	for _, size := range []int{127, 127 * 3, 1000, 65537} {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatalf("rand.Read err: %v", err)
+		}
+		cp := new(commp.Calc)
+		cp.Write(data)
+		refCommP, refPieceSize, err := cp.Digest()
 		if err != nil {
-			fmt.Println("Rename err")
+			t.Fatalf("commp Digest err: %v", err)
+		}
+
+		for _, target := range []uint64{refPieceSize, refPieceSize << 1, 1 << 20, CAR_32GIB_SIZE, MaxPieceSize} {
+			expected, err := commp.PadCommP(refCommP, refPieceSize, target)
+			if err != nil {
+				t.Fatalf("commp PadCommP err: %v", err)
+			}
+			rawCommP, err := PadCommP(refCommP, refPieceSize, target)
+			if err != nil || !bytes.Equal(rawCommP, expected) {
+				t.Errorf("PadCommP of %d bytes to %d: %x %v, expected %x", size, target, rawCommP, err, expected)
+			}
+			if target > 1<<20 {
+				continue
+			}
+
+			// the level cache of GenCommP starts above the tree of a single chunk.
+			if size > SOURCE_CHUNK_SIZE {
+				rawCommP, pieceSize, err := GenCommP(*bytes.NewBuffer(data), cachePath, target)
+				if err != nil || !bytes.Equal(rawCommP, expected) || pieceSize != target {
+					t.Errorf("GenCommP of %d bytes to %d: %x %d %v, expected %x", size, target, rawCommP, pieceSize, err, expected)
+				}
+			}
+
+			// the commP of the data padded with zero leaves is the padded commP.
+			blocks, pieceSize, err := NewPaddedDataBlocksFromBuffer(*bytes.NewBuffer(data), target)
+			if err != nil || pieceSize != target {
+				t.Fatalf("NewPaddedDataBlocksFromBuffer of %d bytes to %d: %d %v", size, target, pieceSize, err)
+			}
+			tree, err := mt.NewWithPadding(CommpHashConfig, blocks, StackedNulPadding)
+			if err != nil || !bytes.Equal(tree.Root, expected) {
+				t.Errorf("padded data blocks of %d bytes to %d: %v, expected %x", size, target, err, expected)
+			}
+		}
+	}
+
+	// 128 bytes of zeros padded to 32GiB is the piece of an empty sector.
+	rawCommP, err := PadCommP(StackedNulPadding[2], 128, CAR_32GIB_SIZE)
+	if err != nil {
+		t.Fatalf("PadCommP err: %v", err)
+	}
+	pieceCid, _ := commcid.DataCommitmentV1ToCID(rawCommP)
+	if pieceCid.String() != "baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq" {
+		t.Errorf("empty 32GiB sector piece: %s", pieceCid)
+	}
+
+	// the leaves of a sector are not held, its commP is padded by PadCommP.
+	if _, _, err := NewPaddedDataBlocksFromBuffer(*bytes.NewBuffer(make([]byte, 127)), CAR_32GIB_SIZE); err == nil {
+		t.Errorf("NewPaddedDataBlocksFromBuffer to %d is expected to fail", uint64(CAR_32GIB_SIZE))
+	}
+	if _, err := NewPaddedDataBlocksFromDataBlocks(nil, MaxPaddedDataBlocksSize, MaxPaddedDataBlocksSize*2); err == nil {
+		t.Errorf("NewPaddedDataBlocksFromDataBlocks to %d is expected to fail", MaxPaddedDataBlocksSize*2)
+	}
+
+	for _, c := range []struct {
+		commP          []byte
+		source, target uint64
+	}{
+		{StackedNulPadding[2][:31], 128, 256},
+		{StackedNulPadding[2], 384, 1024},
+		{StackedNulPadding[2], 128, 384},
+		{StackedNulPadding[2], 256, 128},
+		{StackedNulPadding[2], 64, 128},
+		{StackedNulPadding[2], 128, MaxPieceSize << 1},
+	} {
+		if _, err := PadCommP(c.commP, c.source, c.target); err == nil {
+			t.Errorf("PadCommP of %d bytes to %d is expected to fail", c.source, c.target)
 		}
 	}
 }
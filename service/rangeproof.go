@@ -0,0 +1,157 @@
+package metaservice
+
+import (
+	"bytes"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/ipfs/go-cid"
+	mt "github.com/txaty/go-merkletree"
+	"golang.org/x/xerrors"
+)
+
+// RangeProof proves a byte range of a car belongs to its piece. The range is extended to whole source chunks by
+// Head and Tail, the bytes of the car before and after it, so the verifier computes the leaves of the range.
+// Left and Right prove the first and the last leaf, their siblings outside the range are the only other nodes
+// needed to compute the commP.
+type RangeProof struct {
+	Offset uint64
+	Length uint64
+	Head   []byte
+	Tail   []byte
+	Left   mt.Proof
+	Right  mt.Proof
+}
+
+// GenRangeProof generates the proof of length bytes of the car of the piece commCid from offset on, the car chunks
+// at the ends of the range are read from provider and proven with the level cache file of the piece.
+func GenRangeProof(cacheFile string, commCid cid.Cid, offset, length uint64, provider ChunkProvider) (*RangeProof, error) {
+	if length == 0 {
+		return nil, xerrors.Errorf("the length of the range must be greater than 0")
+	}
+	lc, err := mt.NewLevelCacheFromFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	carChunkSize, carChunkNodes := CarChunkParams(0)
+	if lc.Start == CAR_2MIB_CACHE_LAYER_START {
+		carChunkSize, carChunkNodes = CarChunkParams(CAR_2MIB_CHUNK_SIZE)
+	}
+
+	first := offset / SOURCE_CHUNK_SIZE
+	last := (offset + length - 1) / SOURCE_CHUNK_SIZE
+	proof := &RangeProof{Offset: offset, Length: length}
+
+	// the proofs of the first and the last leaf, from the car chunks of their source chunks.
+	for _, leafIndex := range []uint64{first * CHUNK_NODES_NUM, last*CHUNK_NODES_NUM + CHUNK_NODES_NUM - 1} {
+		chunkIndex := leafIndex / carChunkNodes
+		buf, err := provider.GetChunk(commCid, chunkIndex*carChunkSize, carChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		chunkOffset := chunkIndex * carChunkSize
+		// the range starts in the chunk of the first leaf and ends in the chunk of the last one.
+		if end := chunkOffset + uint64(len(buf)); offset >= end || (leafIndex%CHUNK_NODES_NUM != 0 && offset+length > end) {
+			return nil, xerrors.Errorf("range %d+%d is out of the car of %d bytes", offset, length, end)
+		}
+
+		// the chunk is padded to a whole subtree of the cache layer, as the last chunk of a car is in its piece.
+		blocks, _, err := NewPaddedDataBlocksFromBuffer(*bytes.NewBuffer(buf), carChunkNodes*NODE_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		leafProof, root, err := GenProofAt(blocks, leafIndex%carChunkNodes)
+		if err != nil {
+			return nil, err
+		}
+		cacheProof, _, err := GenProofFromCacheAt(chunkIndex, root, cacheFile)
+		if err != nil {
+			return nil, err
+		}
+		leafProof, err = AppendProof(leafProof, *cacheProof)
+		if err != nil {
+			return nil, err
+		}
+
+		if leafIndex%CHUNK_NODES_NUM == 0 {
+			proof.Left = *leafProof
+			proof.Head = append([]byte(nil), buf[first*SOURCE_CHUNK_SIZE-chunkOffset:offset-chunkOffset]...)
+		} else {
+			proof.Right = *leafProof
+			tailEnd := (last+1)*SOURCE_CHUNK_SIZE - chunkOffset
+			if tailEnd > uint64(len(buf)) {
+				tailEnd = uint64(len(buf))
+			}
+			proof.Tail = append([]byte(nil), buf[offset+length-chunkOffset:tailEnd]...)
+		}
+	}
+
+	return proof, nil
+}
+
+// VerifyRangeProof verifies data is the range of the car of proof in the piece of pieceCid.
+func VerifyRangeProof(data []byte, proof *RangeProof, pieceCid cid.Cid) (bool, error) {
+	if proof == nil {
+		return false, xerrors.Errorf("range proof is nil")
+	}
+	rawCommP, err := commcid.CIDToDataCommitmentV1(pieceCid)
+	if err != nil {
+		return false, err
+	}
+	if proof.Length == 0 || uint64(len(data)) != proof.Length {
+		return false, nil
+	}
+
+	first := proof.Offset / SOURCE_CHUNK_SIZE
+	last := (proof.Offset + proof.Length - 1) / SOURCE_CHUNK_SIZE
+	if uint64(len(proof.Head)) != proof.Offset-first*SOURCE_CHUNK_SIZE {
+		return false, nil
+	}
+	// the tail is short at the end of the car, the rest of its source chunk is zero padded as in the piece.
+	if uint64(len(proof.Tail)) > (last+1)*SOURCE_CHUNK_SIZE-proof.Offset-proof.Length {
+		return false, nil
+	}
+
+	depth := len(proof.Left.Siblings)
+	lo := first * CHUNK_NODES_NUM
+	hi := last*CHUNK_NODES_NUM + CHUNK_NODES_NUM - 1
+	if depth > int(MaxLayers) || len(proof.Right.Siblings) != depth || hi >= 1<<depth {
+		return false, nil
+	}
+	if proofIndex(&proof.Left) != lo || proofIndex(&proof.Right) != hi {
+		return false, nil
+	}
+
+	buf := make([]byte, 0, len(proof.Head)+len(data)+len(proof.Tail))
+	buf = append(append(append(buf, proof.Head...), data...), proof.Tail...)
+	blocks, _, err := NewPaddedDataBlocksFromBuffer(*bytes.NewBuffer(buf), 0)
+	if err != nil {
+		return false, err
+	}
+	nodes := make([][]byte, len(blocks))
+	for i, block := range blocks {
+		if nodes[i], err = block.Serialize(); err != nil {
+			return false, err
+		}
+	}
+
+	// compute the nodes of the range up to the root, the siblings of the proofs complete them at the ends.
+	for h := 0; h < depth; h++ {
+		if lo&1 == 1 {
+			nodes = append([][]byte{proof.Left.Siblings[h]}, nodes...)
+			lo--
+		}
+		if len(nodes)%2 == 1 {
+			nodes = append(nodes, proof.Right.Siblings[h])
+		}
+		next := make([][]byte, len(nodes)/2)
+		for i := range next {
+			if next[i], err = NewHashFunc(append(append(make([]byte, 0, 2*NODE_SIZE), nodes[2*i]...), nodes[2*i+1]...)); err != nil {
+				return false, err
+			}
+		}
+		nodes = next
+		lo >>= 1
+	}
+
+	return bytes.Equal(nodes[0], rawCommP), nil
+}
@@ -0,0 +1,88 @@
+package metaservice
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mt "github.com/txaty/go-merkletree"
+	"gotest.tools/assert"
+)
+
+// storeTestPiece stores the level cache of the piece of the car data under a temporary directory.
+func storeTestPiece(t *testing.T, data []byte) (string, cid.Cid) {
+	w := NewCommPWriter()
+	_, err := w.Write(data)
+	assert.NilError(t, err)
+	cachePath := t.TempDir()
+	assert.NilError(t, w.StoreLevelCache(cachePath))
+	commCid, err := w.PieceCid()
+	assert.NilError(t, err)
+	return filepath.Join(cachePath, commCid.String()+CACHE_SUFFIX), commCid
+}
+
+func TestRangeProof(t *testing.T) {
+	testCar, err := os.ReadFile("../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car")
+	assert.NilError(t, err)
+	rnd := rand.New(rand.NewSource(1))
+	largeCar := make([]byte, 2*CAR_2MIB_CHUNK_SIZE+1000)
+	rnd.Read(largeCar)
+
+	for _, data := range [][]byte{testCar, largeCar} {
+		cacheFile, commCid := storeTestPiece(t, data)
+		provider := NewCarChunkProvider(bytes.NewReader(data))
+		carChunkSize, _ := CarChunkParams(uint64(len(data)))
+		size := uint64(len(data))
+
+		ranges := [][2]uint64{{0, 1}, {0, size}, {126, 2}, {127, 127}, {size - 1, 1}, {size - 200, 200}, {carChunkSize - 3, 10}}
+		for i := 0; i < 16; i++ {
+			offset := uint64(rnd.Int63n(int64(size)))
+			ranges = append(ranges, [2]uint64{offset, 1 + uint64(rnd.Int63n(int64(size-offset)))})
+		}
+		for _, r := range ranges {
+			offset, length := r[0], r[1]
+			proof, err := GenRangeProof(cacheFile, commCid, offset, length, provider)
+			assert.NilError(t, err)
+			rng := data[offset : offset+length]
+			rst, err := VerifyRangeProof(rng, proof, commCid)
+			assert.NilError(t, err)
+			assert.Assert(t, rst, "range %d+%d of %d bytes", offset, length, size)
+
+			// other data, another offset or another piece does not verify.
+			tampered := append([]byte(nil), rng...)
+			tampered[len(tampered)/2] ^= 1
+			rst, _ = VerifyRangeProof(tampered, proof, commCid)
+			assert.Assert(t, !rst)
+			moved := *proof
+			moved.Offset++
+			rst, _ = VerifyRangeProof(rng, &moved, commCid)
+			assert.Assert(t, !rst)
+			other, _ := cid.Parse("baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq")
+			rst, _ = VerifyRangeProof(rng, proof, other)
+			assert.Assert(t, !rst)
+		}
+
+		_, err := GenRangeProof(cacheFile, commCid, size, 1, provider)
+		assert.ErrorContains(t, err, "out of the car")
+		_, err = GenRangeProof(cacheFile, commCid, size-1, 2, provider)
+		assert.ErrorContains(t, err, "out of the car")
+	}
+}
+
+func TestGenProofAt(t *testing.T) {
+	// identical leaves are proven at their index.
+	blocks, _, err := NewPaddedDataBlocksFromBuffer(*bytes.NewBuffer(make([]byte, SOURCE_CHUNK_SIZE*3)), 0)
+	assert.NilError(t, err)
+	for i := range blocks {
+		proof, root, err := GenProofAt(blocks, uint64(i))
+		assert.NilError(t, err)
+		assert.Equal(t, proofIndex(proof), uint64(i))
+		rst, err := mt.Verify(blocks[i], proof, root, CommpHashConfig)
+		assert.NilError(t, err)
+		assert.Assert(t, rst)
+		assert.DeepEqual(t, root, StackedNulPadding[4])
+	}
+}
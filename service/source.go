@@ -0,0 +1,197 @@
+package metaservice
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// SourceReader opens the source files of a dataset by their path relative to the source parent,
+// the chunks of a car are rebuilt from them.
+type SourceReader interface {
+	Open(path string) (SourceFile, error)
+}
+
+// SourceFile is a source file opened by a SourceReader.
+type SourceFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// NewSourceReader creates a SourceReader from the source parent path:
+//
+//	http://host/path, https://host/path  files are read with HTTP range requests below the URL
+//	s3://bucket/prefix                   objects are read with ranged GetObject requests below the prefix,
+//	                                     the endpoint and region query parameters select an S3 compatible store
+//	anything else                        a local directory
+func NewSourceReader(parent string) (SourceReader, error) {
+	u, err := url.Parse(parent)
+	if err != nil || u.Host == "" {
+		return NewLocalSourceReader(parent), nil
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPSourceReader(parent, http.DefaultClient), nil
+	case "s3":
+		cfg := aws.NewConfig()
+		if region := u.Query().Get("region"); region != "" {
+			cfg = cfg.WithRegion(region)
+		}
+		if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+			cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+		}
+		sess, err := session.NewSessionWithOptions(session.Options{
+			Config:            *cfg,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return NewS3SourceReader(s3.New(sess), u.Host, u.Path), nil
+	default:
+		return NewLocalSourceReader(parent), nil
+	}
+}
+
+// LocalSourceReader reads the source files from a local directory.
+type LocalSourceReader struct {
+	parent string
+}
+
+// NewLocalSourceReader creates a LocalSourceReader of the parent directory.
+func NewLocalSourceReader(parent string) *LocalSourceReader {
+	return &LocalSourceReader{parent: parent}
+}
+
+func (r *LocalSourceReader) Open(path string) (SourceFile, error) {
+	return os.Open(filepath.Join(r.parent, path))
+}
+
+// HTTPSourceReader reads the source files with HTTP range requests.
+type HTTPSourceReader struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPSourceReader creates an HTTPSourceReader, the source paths are resolved below baseURL.
+func NewHTTPSourceReader(baseURL string, client *http.Client) *HTTPSourceReader {
+	return &HTTPSourceReader{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+func (r *HTTPSourceReader) Open(p string) (SourceFile, error) {
+	return &httpSourceFile{url: r.baseURL + "/" + escapePath(p), client: r.client}, nil
+}
+
+type httpSourceFile struct {
+	url    string
+	client *http.Client
+}
+
+func (f *httpSourceFile) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, skip to the offset.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return 0, io.EOF
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	default:
+		return 0, fmt.Errorf("read %s: %s", f.url, resp.Status)
+	}
+
+	return readFull(resp.Body, p)
+}
+
+func (f *httpSourceFile) Close() error {
+	return nil
+}
+
+// S3SourceReader reads the source files from the objects of an S3 compatible store.
+type S3SourceReader struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// NewS3SourceReader creates an S3SourceReader, the source paths are keys below prefix in bucket.
+func NewS3SourceReader(client s3iface.S3API, bucket string, prefix string) *S3SourceReader {
+	return &S3SourceReader{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}
+}
+
+func (r *S3SourceReader) Open(p string) (SourceFile, error) {
+	return &s3SourceFile{reader: r, key: path.Join(r.prefix, filepath.ToSlash(p))}, nil
+}
+
+type s3SourceFile struct {
+	reader *S3SourceReader
+	key    string
+}
+
+func (f *s3SourceFile) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	out, err := f.reader.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(f.reader.bucket),
+		Key:    aws.String(f.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("read s3://%s/%s: %w", f.reader.bucket, f.key, err)
+	}
+	defer out.Body.Close()
+
+	return readFull(out.Body, p)
+}
+
+func (f *s3SourceFile) Close() error {
+	return nil
+}
+
+// readFull reads len(p) bytes as io.ReaderAt does, returning io.EOF when the source ends before.
+func readFull(r io.Reader, p []byte) (int, error) {
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// escapePath escapes every element of a relative source path for an URL.
+func escapePath(p string) string {
+	elems := strings.Split(filepath.ToSlash(p), "/")
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	return strings.Join(elems, "/")
+}
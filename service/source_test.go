@@ -0,0 +1,153 @@
+package metaservice
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const sourceTestCar = "../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car"
+
+// checkSourceChunks rebuilds the test car from its mappings with the source data read from srcParent.
+func checkSourceChunks(t *testing.T, srcParent string, opts ...Option) {
+	ms := New(opts...)
+	if err := ms.LoadMetaMappings("../testdata/output/metas/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.json"); err != nil {
+		t.Fatalf("Failed to load mappings: %v", err)
+	}
+	mappings, err := ms.GetAllChunkMappings()
+	if err != nil {
+		t.Fatalf("Failed to get chunks: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "test_output.car")
+	if err := ms.GenerateChunksFromMappings(path, srcParent, mappings); err != nil {
+		t.Fatalf("Failed to generate chunks car: %v", err)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read chunks : %v", err)
+	}
+	carBuf, err := os.ReadFile(sourceTestCar)
+	if err != nil {
+		t.Fatalf("Failed to read car : %v", err)
+	}
+	assert.Assert(t, bytes.Equal(buf, carBuf), "The generated chunks are inconsistent with the car")
+}
+
+func TestHTTPSourceReader(t *testing.T) {
+	var ranges int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges++
+		}
+		http.FileServer(http.Dir("../testdata")).ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	checkSourceChunks(t, srv.URL)
+	assert.Assert(t, ranges > 0)
+
+	// Reads past the end of a file behave like os.File.
+	f, err := NewHTTPSourceReader(srv.URL, srv.Client()).Open("input/test.txt")
+	assert.NilError(t, err)
+	stat, err := os.Stat("../testdata/input/test.txt")
+	assert.NilError(t, err)
+	buf := make([]byte, 10)
+	n, err := f.ReadAt(buf, stat.Size()-4)
+	assert.Equal(t, n, 4)
+	assert.Equal(t, err, io.EOF)
+	_, err = f.ReadAt(buf, stat.Size()+1)
+	assert.Equal(t, err, io.EOF)
+
+	f, err = NewHTTPSourceReader(srv.URL, srv.Client()).Open("input/missing.txt")
+	assert.NilError(t, err)
+	_, err = f.ReadAt(buf, 0)
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestHTTPSourceReaderWithoutRanges(t *testing.T) {
+	// A server ignoring range requests answers with the whole file.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join("../testdata", filepath.FromSlash(strings.TrimPrefix(r.URL.Path, "/"))))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: rangeStripper{http.DefaultTransport}}
+	checkSourceChunks(t, "", Source(NewHTTPSourceReader(srv.URL, client)))
+}
+
+func TestS3SourceReader(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	// A path style S3 stand-in serving the objects below /bucket/dataset from the test data.
+	var ranges int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/dataset/")
+		if r.Method != http.MethodGet || key == r.URL.Path || r.Header.Get("Authorization") == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranges++
+		}
+		f, err := os.Open(filepath.Join("../testdata", filepath.FromSlash(key)))
+		if err != nil {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		info, _ := f.Stat()
+		http.ServeContent(w, r, key, info.ModTime(), f)
+	}))
+	defer srv.Close()
+
+	reader, err := NewSourceReader("s3://bucket/dataset?region=us-east-1&endpoint=" + srv.URL)
+	assert.NilError(t, err)
+	_, ok := reader.(*S3SourceReader)
+	assert.Assert(t, ok)
+
+	checkSourceChunks(t, "", Source(reader))
+	assert.Assert(t, ranges > 0)
+
+	f, err := reader.Open("input/missing.txt")
+	assert.NilError(t, err)
+	_, err = f.ReadAt(make([]byte, 10), 0)
+	assert.ErrorContains(t, err, "NoSuchKey")
+}
+
+func TestNewSourceReader(t *testing.T) {
+	for parent, local := range map[string]bool{
+		"../testdata":             true,
+		"/data/source":            true,
+		"http://localhost/source": false,
+		"https://example.com":     false,
+	} {
+		r, err := NewSourceReader(parent)
+		assert.NilError(t, err)
+		_, ok := r.(*LocalSourceReader)
+		assert.Equal(t, ok, local, parent)
+	}
+
+	checkSourceChunks(t, "../testdata")
+}
+
+// rangeStripper drops the range header of the requests.
+type rangeStripper struct {
+	rt http.RoundTripper
+}
+
+func (s rangeStripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Del("Range")
+	return s.rt.RoundTrip(r)
+}
@@ -0,0 +1,179 @@
+package metaservice
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dataswap/go-metadata/types"
+)
+
+// default number of mappings placed in the car kept in memory before they are spilled to the disk
+const MAPPING_SPILL_LIMIT = 1 << 20
+
+// mappingSpill holds the mappings spilled to the disk in runs sorted by DstOffset, which are merged when the
+// mappings are saved. A run is a sequence of length prefixed records of the binary mapping format.
+type mappingSpill struct {
+	parent string // directory the spill directory is created in
+	limit  int    // number of placed mappings spilled at once
+	dir    string
+	runs   []string
+	shift  int64 // added to the DstOffset of the spilled mappings, see CarWriter.Shift
+}
+
+// writeRun writes the mappings as a new run, sorting them by DstOffset.
+func (s *mappingSpill) writeRun(mappings []*types.ChunkMapping) error {
+	if s.dir == "" {
+		if err := os.MkdirAll(s.parent, 0o775); err != nil {
+			return err
+		}
+		dir, err := os.MkdirTemp(s.parent, ".spill-")
+		if err != nil {
+			return err
+		}
+		s.dir = dir
+	}
+
+	sort.Slice(mappings, func(i int, j int) bool {
+		return mappings[i].DstOffset < mappings[j].DstOffset
+	})
+
+	path := filepath.Join(s.dir, fmt.Sprintf("run%06d", len(s.runs)))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var record []byte
+	for _, m := range mappings {
+		record = appendMappingRecord(record[:0], m)
+		if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+			return err
+		}
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.runs = append(s.runs, path)
+	return nil
+}
+
+// merge calls fn with the mappings of the runs and the sorted in-memory mappings, in the order of DstOffset.
+func (s *mappingSpill) merge(sorted []*types.ChunkMapping, fn func(m *types.ChunkMapping) error) error {
+	h := make(mappingHeap, 0, len(s.runs)+1)
+	for _, path := range s.runs {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r := bufio.NewReader(f)
+		src := func() (*types.ChunkMapping, error) {
+			record, err := readBytes(r)
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			m, err := decodeMappingRecord(record)
+			if err != nil {
+				return nil, err
+			}
+			m.DstOffset = uint64(int64(m.DstOffset) + s.shift)
+			// records do not tell no links from empty ones, the nodes of the importer have none of the latter.
+			if len(m.Links) == 0 {
+				m.Links = nil
+			}
+			return m, nil
+		}
+		if err := h.push(src); err != nil {
+			return fmt.Errorf("spilled mappings %s: %w", path, err)
+		}
+	}
+	if err := h.push(func() (*types.ChunkMapping, error) {
+		if len(sorted) == 0 {
+			return nil, nil
+		}
+		m := sorted[0]
+		sorted = sorted[1:]
+		return m, nil
+	}); err != nil {
+		return err
+	}
+
+	heap.Init(&h)
+	for h.Len() != 0 {
+		top := &h[0]
+		if err := fn(top.m); err != nil {
+			return err
+		}
+		m, err := top.next()
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			heap.Pop(&h)
+			continue
+		}
+		top.m = m
+		heap.Fix(&h, 0)
+	}
+	return nil
+}
+
+// remove deletes the runs.
+func (s *mappingSpill) remove() error {
+	if s.dir == "" {
+		return nil
+	}
+	s.runs = nil
+	dir := s.dir
+	s.dir = ""
+	return os.RemoveAll(dir)
+}
+
+// mappingSource is a source of mappings of the merge, the next mapping sorted by DstOffset or nil at the end.
+type mappingSource func() (*types.ChunkMapping, error)
+
+type mappingHead struct {
+	m    *types.ChunkMapping
+	next mappingSource
+}
+
+// mappingHeap is a min-heap of the next mapping of every source of the merge.
+type mappingHeap []mappingHead
+
+// push adds the source unless it is empty, the heap is initialized afterwards.
+func (h *mappingHeap) push(src mappingSource) error {
+	m, err := src()
+	if err != nil || m == nil {
+		return err
+	}
+	*h = append(*h, mappingHead{m: m, next: src})
+	return nil
+}
+
+func (h mappingHeap) Len() int           { return len(h) }
+func (h mappingHeap) Less(i, j int) bool { return h[i].m.DstOffset < h[j].m.DstOffset }
+func (h mappingHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mappingHeap) Push(x any)        { *h = append(*h, x.(mappingHead)) }
+func (h *mappingHeap) Pop() any {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
@@ -0,0 +1,70 @@
+package metaservice
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dataswap/go-metadata/libs"
+	"github.com/dataswap/go-metadata/types"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car"
+	"gotest.tools/assert"
+)
+
+func TestSpillMappings(t *testing.T) {
+	dir, paths := newTestFiles(t)
+	params := types.DagParams{Prefix: merkledag.V1CidPrefix(), Chunker: "size-256", Layout: libs.BalancedLayout, RawLeaves: true, MaxLinks: 3}
+	metaPath := t.TempDir()
+
+	expectedCar, ms := buildTestCar(t, dir, paths, params, 0, 0)
+	assert.NilError(t, ms.SaveMetaMappings(metaPath, "expected.json"))
+	expected, err := os.ReadFile(filepath.Join(metaPath, "expected.json"))
+	assert.NilError(t, err)
+
+	for _, workers := range []int{0, 3} {
+		spillPath := filepath.Join(t.TempDir(), "spill")
+		carBuf, ms := buildTestCar(t, dir, paths, params, workers, FILE_POOL_BUFFER_SIZE, SpillMappings(spillPath, 7))
+		assert.Assert(t, bytes.Equal(carBuf, expectedCar))
+
+		// The mappings of duplicate blocks are dropped whether the first ones are spilled or not.
+		runs, err := filepath.Glob(filepath.Join(spillPath, ".spill-*", "run*"))
+		assert.NilError(t, err)
+		assert.Assert(t, len(runs) > 1)
+		assert.Assert(t, len(ms.mappings) < 7)
+
+		// The runs merged with the mappings left in memory are saved as if none was spilled.
+		assert.NilError(t, ms.SaveMetaMappings(metaPath, "spilled.json"))
+		spilled, err := os.ReadFile(filepath.Join(metaPath, "spilled.json"))
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(spilled, expected), "the mappings spilled with %d workers differ", workers)
+		assert.ErrorContains(t, ms.SaveBinaryMetaMappings(metaPath, "spilled.bin"), "json format")
+
+		// The offsets of the blocks spilled by the car are merged into a few runs, every block is still found.
+		indexRuns, err := filepath.Glob(filepath.Join(spillPath, ".index-*", "run*"))
+		assert.NilError(t, err)
+		assert.Assert(t, len(indexRuns) > 0 && len(indexRuns) <= BLOCK_INDEX_MAX_RUNS)
+		cr, err := car.NewCarReader(bytes.NewReader(carBuf))
+		assert.NilError(t, err)
+		var n int
+		for block, err := cr.Next(); err == nil; block, err = cr.Next() {
+			has, err := ms.car.Has(context.Background(), block.Cid())
+			assert.NilError(t, err)
+			assert.Assert(t, has, "block %s is not found", block.Cid())
+			n++
+		}
+		assert.Assert(t, n > 8*7)
+		missing, err := params.Prefix.Sum([]byte("missing"))
+		assert.NilError(t, err)
+		has, err := ms.car.Has(context.Background(), missing)
+		assert.NilError(t, err)
+		assert.Assert(t, !has)
+
+		assert.NilError(t, ms.Close())
+		runs, err = filepath.Glob(filepath.Join(spillPath, ".*"))
+		assert.NilError(t, err)
+		assert.Equal(t, len(runs), 0)
+	}
+}
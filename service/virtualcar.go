@@ -0,0 +1,209 @@
+package metaservice
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/data-preservation-programs/singularity/pack"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// VirtualCar is a CAR file rebuilt from the mapping information and the source data on demand, without
+// writing it out. Any byte range is assembled from the header and the blocks overlapping it.
+type VirtualCar struct {
+	ms         *MappingService
+	reader     SourceReader
+	cidBuilder cid.Builder
+	header     []byte
+	size       uint64
+
+	// the last rebuilt block, sequential reads smaller than a block rebuild it once.
+	lk         sync.Mutex
+	blockStart uint64
+	block      []byte
+
+	offset int64 // offset of Read
+}
+
+var (
+	_ io.ReaderAt   = (*VirtualCar)(nil)
+	_ io.ReadSeeker = (*VirtualCar)(nil)
+)
+
+// NewVirtualCar creates the VirtualCar of the mappings loaded into ms, the source data is read through
+// the Source option of ms or else from srcParent.
+func NewVirtualCar(ms *MappingService, srcParent string) (*VirtualCar, error) {
+	reader, err := ms.sourceReader(srcParent)
+	if err != nil {
+		return nil, err
+	}
+	header, err := pack.GenerateCarHeader(ms.dataRoot)
+	if err != nil {
+		return nil, err
+	}
+	size, err := ms.CarSize()
+	if err != nil {
+		return nil, err
+	}
+
+	return &VirtualCar{
+		ms:         ms,
+		reader:     reader,
+		cidBuilder: ms.CidBuilder(),
+		header:     header,
+		size:       size,
+	}, nil
+}
+
+// RegenerateCar rebuilds the car of the mappings loaded into ms from the source data to outPath, or only checks it
+// when outPath is empty. It fails unless the commP of the car is the one of pieceCid, the car written to outPath is
+// then removed. It returns the commP writer the car was hashed into.
+func RegenerateCar(ms *MappingService, srcParent string, pieceCid cid.Cid, outPath string) (cw *CommPWriter, err error) {
+	vc, err := NewVirtualCar(ms, srcParent)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer = io.Discard
+	if outPath != "" {
+		var f *os.File
+		if f, err = os.Create(outPath); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(outPath) //nolint:errcheck
+			}
+		}()
+		out = f
+	}
+
+	cw = NewCommPWriter()
+	if _, err = io.Copy(io.MultiWriter(out, cw), vc); err != nil {
+		return nil, err
+	}
+	commCid, err := cw.PieceCid()
+	if err != nil {
+		return nil, err
+	}
+	if !commCid.Equals(pieceCid) {
+		return nil, xerrors.Errorf("regenerated car has piece CID %s, expected %s", commCid, pieceCid)
+	}
+	return cw, nil
+}
+
+// Size returns the size of the CAR file.
+func (vc *VirtualCar) Size() int64 {
+	return int64(vc.size)
+}
+
+// ReadAt reads len(p) bytes of the CAR file from off, io.EOF is returned when the range goes past its end.
+func (vc *VirtualCar) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("virtual car: negative offset")
+	}
+	if uint64(off) >= vc.size {
+		return 0, io.EOF
+	}
+	start := uint64(off)
+	n := len(p)
+	if uint64(n) > vc.size-start {
+		n = int(vc.size - start)
+	}
+	end := start + uint64(n)
+
+	if start < uint64(len(vc.header)) {
+		copy(p[:n], vc.header[start:])
+	}
+
+	if end > uint64(len(vc.header)) {
+		mappings, err := vc.ms.GetChunkMappings(start, end-start-1)
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range mappings {
+			if m.DstOffset >= end || m.DstOffset+m.ChunkSize <= start {
+				continue
+			}
+			block, err := vc.blockBytes(m.DstOffset, func() ([]byte, error) {
+				node, err := vc.ms.generateNode(vc.reader, m, vc.cidBuilder)
+				if err != nil {
+					return nil, err
+				}
+				var buf bytes.Buffer
+				if _, err := pack.WriteCarBlock(&buf, node); err != nil {
+					return nil, err
+				}
+				return buf.Bytes(), nil
+			})
+			if err != nil {
+				return 0, err
+			}
+			if m.DstOffset >= start {
+				copy(p[m.DstOffset-start:n], block)
+			} else {
+				copy(p[:n], block[start-m.DstOffset:])
+			}
+		}
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read reads from the offset of the last Read or Seek.
+func (vc *VirtualCar) Read(p []byte) (int, error) {
+	n, err := vc.ReadAt(p, vc.offset)
+	vc.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read.
+func (vc *VirtualCar) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += vc.offset
+	case io.SeekEnd:
+		offset += vc.Size()
+	default:
+		return 0, errors.New("virtual car: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("virtual car: negative position")
+	}
+	vc.offset = offset
+	return offset, nil
+}
+
+// blockBytes returns the bytes of the block at start, rebuilt by build unless it is the last rebuilt one.
+func (vc *VirtualCar) blockBytes(start uint64, build func() ([]byte, error)) ([]byte, error) {
+	vc.lk.Lock()
+	if vc.block != nil && vc.blockStart == start {
+		defer vc.lk.Unlock()
+		return vc.block, nil
+	}
+	vc.lk.Unlock()
+
+	block, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	vc.lk.Lock()
+	vc.blockStart, vc.block = start, block
+	vc.lk.Unlock()
+	return block, nil
+}
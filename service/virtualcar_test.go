@@ -0,0 +1,143 @@
+package metaservice
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"gotest.tools/assert"
+)
+
+func newTestVirtualCar(t *testing.T) (*VirtualCar, []byte) {
+	carBuf, err := os.ReadFile("../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car")
+	if err != nil {
+		t.Fatalf("Failed to read car : %v", err)
+	}
+
+	ms := New()
+	if err := ms.LoadMetaMappings("../testdata/output/metas/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.json"); err != nil {
+		t.Fatalf("Failed to load mappings: %v", err)
+	}
+	vc, err := NewVirtualCar(ms, "../testdata")
+	if err != nil {
+		t.Fatalf("Failed to create virtual car: %v", err)
+	}
+	assert.Equal(t, vc.Size(), int64(len(carBuf)))
+	return vc, carBuf
+}
+
+func TestVirtualCarReadAt(t *testing.T) {
+	vc, carBuf := newTestVirtualCar(t)
+	carSize := int64(len(carBuf))
+
+	// Ranges in the header, across blocks and past the end of the car.
+	for _, size := range []int64{1, 59, 140, 512, carSize} {
+		for off := int64(0); off < carSize; off += 13 {
+			buf := make([]byte, size)
+			n, err := vc.ReadAt(buf, off)
+			end := off + size
+			if end > carSize {
+				end = carSize
+				assert.Equal(t, err, io.EOF)
+			} else {
+				assert.NilError(t, err)
+			}
+			assert.Equal(t, n, int(end-off))
+			assert.Assert(t, bytes.Equal(buf[:n], carBuf[off:end]), "range %d+%d differs from the car", off, size)
+		}
+	}
+
+	n, err := vc.ReadAt(make([]byte, 10), carSize)
+	assert.Equal(t, n, 0)
+	assert.Equal(t, err, io.EOF)
+}
+
+func TestVirtualCarReadSeek(t *testing.T) {
+	vc, carBuf := newTestVirtualCar(t)
+
+	var buf bytes.Buffer
+	_, err := io.CopyBuffer(&buf, vc, make([]byte, 100))
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(buf.Bytes(), carBuf))
+
+	pos, err := vc.Seek(-50, io.SeekEnd)
+	assert.NilError(t, err)
+	rest, err := io.ReadAll(vc)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(rest, carBuf[pos:]))
+
+	_, err = vc.Seek(-1, io.SeekStart)
+	assert.Assert(t, err != nil)
+}
+
+func TestVirtualCarConcurrent(t *testing.T) {
+	vc, carBuf := newTestVirtualCar(t)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 97)
+			for off := int64(i); off < int64(len(carBuf)); off += 97 * int64(len(errs)) {
+				n, err := vc.ReadAt(buf, off)
+				if err != nil && err != io.EOF || !bytes.Equal(buf[:n], carBuf[off:off+int64(n)]) {
+					errs[i] = io.ErrUnexpectedEOF
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NilError(t, err)
+	}
+}
+
+func TestRegenerateCar(t *testing.T) {
+	carBuf, err := os.ReadFile("../testdata/output/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.car")
+	assert.NilError(t, err)
+	pieceCid, err := cid.Parse("baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi")
+	assert.NilError(t, err)
+	ms := New()
+	assert.NilError(t, ms.LoadMetaMappings("../testdata/output/metas/baga6ea4seaqopy46styyssotgxlat2vh3ksiukehesphcvoprskkq74o2yudmoi.json"))
+
+	// the car is rebuilt bit-for-bit with its piece CID.
+	outPath := filepath.Join(t.TempDir(), "test.car")
+	cw, err := RegenerateCar(ms, "../testdata", pieceCid, outPath)
+	assert.NilError(t, err)
+	commCid, err := cw.PieceCid()
+	assert.NilError(t, err)
+	assert.Equal(t, commCid, pieceCid)
+	assert.Equal(t, cw.Size(), uint64(len(carBuf)))
+	regenerated, err := os.ReadFile(outPath)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(regenerated, carBuf))
+	_, err = RegenerateCar(ms, "../testdata", pieceCid, "")
+	assert.NilError(t, err)
+
+	// a changed source file or another piece CID fails, the output is removed.
+	other, err := cid.Parse("baga6ea4seaqkq2y6yhslmwrm4472d4qkzqubeki73z3qeei23e6bejuzjdxiygy")
+	assert.NilError(t, err)
+	_, err = RegenerateCar(ms, "../testdata", other, outPath)
+	assert.ErrorContains(t, err, "expected "+other.String())
+	_, err = os.Stat(outPath)
+	assert.Assert(t, os.IsNotExist(err))
+
+	parent := t.TempDir()
+	src, err := os.ReadFile("../testdata/input/test.txt")
+	assert.NilError(t, err)
+	src[len(src)/2] ^= 1
+	assert.NilError(t, os.MkdirAll(filepath.Join(parent, "input"), 0755))
+	assert.NilError(t, os.WriteFile(filepath.Join(parent, "input", "test.txt"), src, 0644))
+	_, err = RegenerateCar(ms, parent, pieceCid, outPath)
+	assert.Assert(t, err != nil)
+	_, err = os.Stat(outPath)
+	assert.Assert(t, os.IsNotExist(err))
+}
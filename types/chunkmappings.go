@@ -8,15 +8,16 @@ import (
 
 // chunk meta mapping
 type ChunkMapping struct {
-	SrcPath   string           `json:"srcpath"`   // the path of chunk's source data
-	SrcOffset uint64           `json:"srcoffset"` // the offset of chunk data in source data
-	Size      uint64           `json:"size"`      // chunk data size
-	DstOffset uint64           `json:"dstoffset"` // the offset of chunk in car
-	ChunkSize uint64           `json:"chunksize"` // node size
-	BlockSize uint64           `json:"blocksize"` // node blocksize
-	NodeType  pb.Data_DataType `json:"nodetype"`  // node data type
-	Cid       cid.Cid          `json:"cid"`       // node cid
-	Links     []*ipld.Link     `json:links`       // chunks of node
+	SrcPath   string           `json:"srcpath"`        // the path of chunk's source data
+	SrcOffset uint64           `json:"srcoffset"`      // the offset of chunk data in source data
+	Size      uint64           `json:"size"`           // chunk data size
+	DstOffset uint64           `json:"dstoffset"`      // the offset of chunk in car
+	ChunkSize uint64           `json:"chunksize"`      // node size
+	BlockSize uint64           `json:"blocksize"`      // node blocksize
+	NodeType  pb.Data_DataType `json:"nodetype"`       // node data type
+	Cid       cid.Cid          `json:"cid"`            // node cid
+	Links     []*ipld.Link     `json:"links"`          // chunks of node
+	Data      []byte           `json:"data,omitempty"` // unixfs data of directory nodes
 }
 
 func (cm *ChunkMapping) ChunkRangeInCar() (uint64, uint64) {
@@ -29,12 +30,23 @@ func (cm *ChunkMapping) ChunkRanageInSource() (string, uint64, uint64) {
 
 // source info
 type SrcData struct {
-	Path   string
-	Offset uint64
-	Size   uint64
+	Path   string `json:"path"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+// parameters the DAG of a car was built with
+type DagParams struct {
+	Prefix    cid.Prefix `json:"prefix"`    // CID prefix of the nodes, raw leaves have the raw codec instead
+	Chunker   string     `json:"chunker"`   // chunker spec, as accepted by go-ipfs-chunker's FromString
+	Layout    string     `json:"layout"`    // balanced or trickle
+	RawLeaves bool       `json:"rawleaves"` // leaves are raw nodes
+	MaxLinks  int        `json:"maxlinks"`  // maximum number of links of a node
 }
 
 type Mapping struct {
+	Version  uint64          `json:"version"` // schema version, 0 for mapping files without DAG parameters
 	DataRoot cid.Cid         `json:"dagroot"`
+	Params   *DagParams      `json:"params,omitempty"`
 	Mappings []*ChunkMapping `json:"mappings"`
 }
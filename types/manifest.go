@@ -0,0 +1,27 @@
+package types
+
+import (
+	"github.com/ipfs/go-cid"
+)
+
+// the source data range packed into a car
+type FileRange struct {
+	SrcData
+	DagPath string `json:"dagpath"` // the path of the file in the car's root directory
+}
+
+// a car created by packing a dataset
+type CarManifest struct {
+	Name      string       `json:"name"`      // car file name
+	DataRoot  cid.Cid      `json:"dagroot"`   // root of the car's unixfs dag
+	PieceCid  cid.Cid      `json:"piececid"`  // commP of the car
+	PieceSize uint64       `json:"piecesize"` // padded piece size
+	CarSize   uint64       `json:"carsize"`   // car file size
+	Files     []*FileRange `json:"files"`     // source data ranges in the car
+}
+
+// the index of the cars a dataset was packed into
+type PackManifest struct {
+	TargetSize uint64         `json:"targetsize"` // target padded piece size
+	Cars       []*CarManifest `json:"cars"`
+}